@@ -1,42 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/muka/go-bluetooth/bluez"
-	"github.com/muka/go-bluetooth/bluez/profile/gatt"
+	"github.com/Depau/consmart-ble-mqtt/triones"
+	"sync/atomic"
+	"time"
 )
 
-var LightModes = map[string]uint8{
-	"smooth rainbow":       37,
-	"pulsating red":        38,
-	"pulsating green":      39,
-	"pulsating blue":       40,
-	"pulsating yellow":     41,
-	"pulsating cyan":       42,
-	"pulsating magenta":    43,
-	"pulsating white":      44,
-	"pulsating red/green":  45,
-	"pulsating red/blue":   46,
-	"pulsating green/blue": 47,
-	"rainbow strobe":       48,
-	"red strobe":           49,
-	"green strobe":         50,
-	"blue strobe":          51,
-	"yellow strobe":        52,
-	"cyan strobe":          53,
-	"magenta strobe":       54,
-	"white strobe":         55,
-	"hard rainbow":         56,
-	"pulsating RGB":        97,
-	"RGB strobe":           98,
-	"hard RGB":             99,
-	"control":              65, // Not settable with SetMode
-}
-
-var reverseLightModes map[uint8]string = nil
-
 type LightStatus struct {
 	R                  uint8
 	G                  uint8
@@ -49,11 +22,14 @@ type LightStatus struct {
 }
 
 type bleLight struct {
-	rgbCharacteristic    *gatt.GattCharacteristic1
-	notifyCharacteristic *gatt.GattCharacteristic1
-	statusChan           chan<- LightStatus
-	stopRope             StopRope
-	propertyChangedChan  chan *bluez.PropertyChanged
+	transport      Transport
+	writer         *lightWriter
+	statusChan     chan<- LightStatus
+	frameErrorChan chan<- *triones.FrameError
+	badFrames      *uint64
+	metrics        *deviceMetrics
+	calibration    *calibration
+	log            *fieldLogger
 }
 
 type BleLight interface {
@@ -63,159 +39,166 @@ type BleLight interface {
 	SetMode(mode string, speed uint8) (err error)
 	SetModeNumber(mode uint8, speed uint8) (err error)
 	RequestLightStatus() (err error)
-	ListenNotifications() (err error)
+	// RunWriter sends the queued commands to the light until ctx is cancelled
+	RunWriter(ctx context.Context) (err error)
+	// ListenNotifications decodes status notifications from the light until ctx is cancelled or they stop coming
+	ListenNotifications(ctx context.Context) (err error)
+	WriteStats() WriteStats
+	BadFrames() uint64
 }
 
 func NewBleLight(
-	rgbCharacteristic *gatt.GattCharacteristic1,
-	notifyCharacteristic *gatt.GattCharacteristic1,
+	transport Transport,
 	statusChan chan<- LightStatus,
-	stopRope StopRope,
+	frameErrorChan chan<- *triones.FrameError,
+	minWriteInterval time.Duration,
+	metrics *deviceMetrics,
+	calibration *calibration,
+	log *fieldLogger,
 ) BleLight {
 	return bleLight{
-		rgbCharacteristic:    rgbCharacteristic,
-		notifyCharacteristic: notifyCharacteristic,
-		statusChan:           statusChan,
-		stopRope:             stopRope,
+		transport:      transport,
+		writer:         newLightWriter(transport, minWriteInterval, metrics, log),
+		statusChan:     statusChan,
+		frameErrorChan: frameErrorChan,
+		badFrames:      new(uint64),
+		metrics:        metrics,
+		calibration:    calibration,
+		log:            log,
 	}
 }
 
-func makeSetColorPayload(r uint8, g uint8, b uint8, brightness uint8, warmWhite bool) []byte {
-	payload := make([]byte, 7)
-	payload[0] = 0x56
-	payload[1] = r
-	payload[2] = g
-	payload[3] = b
-	payload[4] = brightness
-	if warmWhite {
-		payload[5] = 0x0F
-	} else {
-		payload[5] = 0xF0
+// Encodes a command and queues it for writing
+func (light bleLight) send(kind writeKind, command triones.Command) error {
+	payload, err := command.Encode()
+	if err != nil {
+		return err
+	}
+	return light.writer.Enqueue(kind, payload)
+}
+
+// Calibrates a color and queues it for writing
+func (light bleLight) sendColor(color lightColor) error {
+	raw := light.calibration.Encode(color)
+	if raw.white {
+		return light.send(writeKindAppearance, triones.SetWhite{Intensity: raw.w})
 	}
-	payload[6] = 0xAA
-	return payload
+	return light.send(writeKindAppearance, triones.SetColor{R: raw.r, G: raw.g, B: raw.b})
 }
 
 func (light bleLight) SetRGB(r uint8, g uint8, b uint8) error {
-	payload := makeSetColorPayload(r, g, b, 0, false)
-	return light.rgbCharacteristic.WriteValue(payload, nil)
+	return light.sendColor(lightColor{r: r, g: g, b: b})
 }
 
 func (light bleLight) SetWarmWhite(intensity uint8) error {
-	payload := makeSetColorPayload(0, 0, 0, intensity, true)
-	return light.rgbCharacteristic.WriteValue(payload, nil)
+	return light.sendColor(lightColor{white: true, w: intensity})
 }
 
 func (light bleLight) SetPower(powerOn bool) error {
-	payload := make([]byte, 3)
-	payload[0] = 0xCC
-	if powerOn {
-		payload[1] = 0x23
-	} else {
-		payload[1] = 0x24
-	}
-	payload[2] = 0x33
-	return light.rgbCharacteristic.WriteValue(payload, nil)
+	return light.send(writeKindPower, triones.SetPower{On: powerOn})
 }
 
 func (light bleLight) SetMode(mode string, speed uint8) error {
-	if val, ok := LightModes[mode]; !ok {
+	if val, ok := triones.ModeByName(mode); !ok {
 		return errors.New(fmt.Sprintf("mode '%s' is not valid", mode))
 	} else {
-		return light.SetModeNumber(val, speed)
+		return light.SetModeNumber(uint8(val), speed)
 	}
 }
 
 func (light bleLight) SetModeNumber(mode uint8, speed uint8) error {
-	if mode == 65 {
-		return errors.New("RGB control mode can't be set with SetMode")
-	} else if speed > 31 || speed < 1 {
-		return errors.New("speed must be between 1 and 31 (and is inversely proportional)")
-	} else {
-		payload := make([]byte, 4)
-		payload[0] = 0xBB
-		payload[1] = mode
-		payload[2] = speed
-		payload[3] = 0x44
-		return light.rgbCharacteristic.WriteValue(payload, nil)
-	}
+	return light.send(writeKindAppearance, triones.SetMode{Mode: triones.Mode(mode), Speed: speed})
 }
 
 func (light bleLight) RequestLightStatus() error {
-	payload := []byte{0xEF, 0x01, 0x77}
-	return light.rgbCharacteristic.WriteValue(payload, nil)
+	payload, _ := triones.RequestStatus{}.Encode()
+	return light.writer.Write(writeKindStatusRequest, payload)
+}
+
+func (light bleLight) RunWriter(ctx context.Context) error {
+	return light.writer.Run(ctx)
+}
+
+func (light bleLight) WriteStats() WriteStats {
+	return light.writer.Stats()
+}
+
+// Number of notifications, or parts of them, that couldn't be decoded
+func (light bleLight) BadFrames() uint64 {
+	return atomic.LoadUint64(light.badFrames)
 }
 
-func (light bleLight) propertyChangedWatcher() {
-	if err := light.stopRope.Hold(); err != nil {
+// Counts a frame that couldn't be decoded and hands it over for debugging, never blocking
+func (light bleLight) reportBadFrame(err error) {
+	atomic.AddUint64(light.badFrames, 1)
+	light.metrics.BadFrame()
+
+	frameErr, ok := err.(*triones.FrameError)
+	if !ok {
+		light.log.Debug("unable to decode notification: ", err)
 		return
 	}
-	defer light.stopRope.Release()
-	
-	if err := light.notifyCharacteristic.StartNotify(); err != nil {
-		return
+	light.log.Debugf("unrecognized notification value (%v), don't know how to handle: %s", frameErr.Err, hex.Dump(frameErr.Frame))
+
+	select {
+	case light.frameErrorChan <- frameErr:
+	default:
+	}
+}
+
+func (light bleLight) ListenNotifications(ctx context.Context) error {
+	notificationChan, err := light.transport.Subscribe()
+	if err != nil {
+		return err
 	}
+	defer light.unsubscribe()
+	defer light.log.Debug("stopped listening for notifications")
+
+	parser := triones.FrameParser{}
 
-Loop:
 	for {
 		select {
-		case prop, ok := <-light.propertyChangedChan:
-			if !ok || prop == nil {
-				break Loop
+		case value, ok := <-notificationChan:
+			if !ok {
+				return errors.New("notifications from light stopped")
 			}
-			if prop.Interface != "org.bluez.GattCharacteristic1" || prop.Name != "Value" {
-				break
-			}
-			value := prop.Value.([]byte)
 
-			if value[0] != 0x66 || len(value) < 10 {
-				hexdump := hex.Dump(value)
-				log.Debug("unrecognized notification value, don't know how to handle: ", hexdump)
-				continue Loop
+			statuses, errs := parser.Feed(value)
+			for _, err := range errs {
+				light.reportBadFrame(err)
+			}
+			for i := range statuses {
+				status := makeLightStatus(&statuses[i])
+				light.calibration.DecodeStatus(&status)
+				select {
+				case light.statusChan <- status:
+				case <-ctx.Done():
+					return nil
+				}
 			}
 
-			lightStatus := LightStatus{}
-			lightStatus.Power = value[2] == 0x23
-			lightStatus.Mode = reverseLightModes[value[3]]
-			lightStatus.Speed = value[5]
-			lightStatus.R = value[6]
-			lightStatus.G = value[7]
-			lightStatus.B = value[8]
-			lightStatus.WarmWhiteIntensity = value[9]
-			lightStatus.WarmWhite = lightStatus.WarmWhiteIntensity != 0 || lightStatus.Mode != "control"
-
-			light.statusChan <- lightStatus
-
-		case <-light.stopRope.WaitCut():
-			break Loop
+		case <-ctx.Done():
+			return nil
 		}
 	}
-	log.Debug("stopped listening for notifications")
-
-	if err := light.notifyCharacteristic.StopNotify(); err != nil {
-    log.Error("failed to stop notifications from light")
-  }
-  if err := light.notifyCharacteristic.UnwatchProperties(light.propertyChangedChan); err != nil {
-    log.Error("failed to stop watching notifications")
-  }
 }
 
-func populateReverseLightModes() {
-	reverseLightModes = make(map[uint8]string)
-	for key, val := range LightModes {
-		reverseLightModes[val] = key
+func (light bleLight) unsubscribe() {
+	// The light may be gone already, in which case there's nothing to stop
+	if err := light.transport.Unsubscribe(); err != nil {
+		light.log.Debug("failed to stop notifications from light: ", err)
 	}
 }
 
-func (light bleLight) ListenNotifications() (err error) {
-	if reverseLightModes == nil {
-		populateReverseLightModes()
+func makeLightStatus(status *triones.Status) LightStatus {
+	return LightStatus{
+		R:                  status.R,
+		G:                  status.G,
+		B:                  status.B,
+		Power:              status.Power,
+		WarmWhite:          status.White != 0 || status.Mode != triones.ModeControl,
+		WarmWhiteIntensity: status.White,
+		Mode:               status.Mode.Name(),
+		Speed:              status.Speed,
 	}
-
-	if light.propertyChangedChan, err = light.notifyCharacteristic.WatchProperties(); err != nil {
-		return
-	}
-
-	go light.propertyChangedWatcher()
-	return
 }
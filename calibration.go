@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Channels of the calibration settings, in the order they're kept in
+const (
+	calibrationRed = iota
+	calibrationGreen
+	calibrationBlue
+	calibrationWhite
+)
+
+var calibrationChannelNames = []string{"r", "g", "b", "w"}
+
+// Frame sent to the light, and the color it was asked to show
+type calibratedFrame struct {
+	raw       lightColor
+	requested lightColor
+}
+
+// Turns the colors the bridge works with into what is sent to a light so they look like they should, and the colors
+// the light reports back into the ones they were sent for.
+//
+// Each channel goes through its gamma, then the white balance gain of the RGB channels, then it's scaled to its max.
+// All of these can be undone, but small values are rounded to the same one: statuses that report what the bridge
+// sent last are decoded to exactly what it was asked to show, so they match the command that sent them.
+type calibration struct {
+	gamma [4]float64
+	gain  [4]float64
+	max   [4]float64
+	// RGB colors with a saturation up to this, between 0 and 1, are shown by the white LEDs. Negative if none is.
+	whiteThreshold float64
+
+	lock *sync.Mutex
+	// Last frame sent with the RGB LEDs and with the white ones
+	lastRGB   *calibratedFrame
+	lastWhite *calibratedFrame
+}
+
+func getCalibrationChannels(channels *CalibrationChannels, defaultValue float64) [4]float64 {
+	values := [4]float64{defaultValue, defaultValue, defaultValue, defaultValue}
+	if channels == nil {
+		return values
+	}
+	for i, value := range []*float64{channels.R, channels.G, channels.B, channels.W} {
+		if value != nil {
+			values[i] = *value
+		}
+	}
+	return values
+}
+
+// Returns the calibration of the light, nil if it has none
+func getCalibration(deviceConfig *DeviceConfig) *calibration {
+	config := deviceConfig.Calibration
+	if config == nil {
+		return nil
+	}
+
+	cal := &calibration{
+		gamma:          getCalibrationChannels(config.Gamma, 1),
+		gain:           getCalibrationChannels(config.WhiteBalance, 1),
+		max:            getCalibrationChannels(config.Max, 255),
+		whiteThreshold: -1,
+		lock:           &sync.Mutex{},
+	}
+	// Only the ratios between the RGB channels matter, the brightest one is left at full
+	brightest := math.Max(cal.gain[calibrationRed], math.Max(cal.gain[calibrationGreen], cal.gain[calibrationBlue]))
+	for i := calibrationRed; i <= calibrationBlue; i++ {
+		cal.gain[i] /= brightest
+	}
+	cal.gain[calibrationWhite] = 1
+	if config.WhiteThreshold != nil {
+		cal.whiteThreshold = *config.WhiteThreshold / 100
+	}
+	return cal
+}
+
+func validateCalibrationConfig(config *CalibrationConfig) error {
+	gamma := getCalibrationChannels(config.Gamma, 1)
+	gain := getCalibrationChannels(config.WhiteBalance, 1)
+	max := getCalibrationChannels(config.Max, 255)
+	for i, name := range calibrationChannelNames {
+		if gamma[i] <= 0 || gamma[i] > 5 {
+			return errors.New(fmt.Sprintf("calibration gamma of '%s' must be between 0 and 5", name))
+		}
+		if gain[i] <= 0 {
+			return errors.New(fmt.Sprintf("calibration white_balance of '%s' must be positive", name))
+		}
+		if max[i] < 1 || max[i] > 255 {
+			return errors.New(fmt.Sprintf("calibration max of '%s' must be between 1 and 255", name))
+		}
+	}
+	if config.WhiteBalance != nil && config.WhiteBalance.W != nil {
+		return errors.New("calibration white_balance only applies to 'r', 'g' and 'b'")
+	}
+	if config.WhiteThreshold != nil && (*config.WhiteThreshold < 0 || *config.WhiteThreshold > 100) {
+		return errors.New("calibration white_threshold must be between 0 and 100")
+	}
+	return nil
+}
+
+func (cal *calibration) encodeChannel(channel int, value uint8) uint8 {
+	linear := math.Pow(float64(value)/255, cal.gamma[channel]) * cal.gain[channel]
+	return uint8(math.Round(linear * cal.max[channel]))
+}
+
+func (cal *calibration) decodeChannel(channel int, value uint8) uint8 {
+	linear := math.Min(1, float64(value)/cal.max[channel]/cal.gain[channel])
+	return uint8(math.Round(math.Pow(linear, 1/cal.gamma[channel]) * 255))
+}
+
+// Returns what has to be sent to the light to show the color. Does nothing on a nil *calibration.
+func (cal *calibration) Encode(color lightColor) lightColor {
+	if cal == nil {
+		return color
+	}
+
+	requested := color
+	if !color.white && cal.whiteThreshold >= 0 {
+		rgb := jsonColor{R: color.r, G: color.g, B: color.b}
+		if _, saturation, _ := rgbToHsv(rgb); saturation <= cal.whiteThreshold {
+			color = lightColor{white: true, w: colorBrightness(rgb)}
+		}
+	}
+
+	var raw lightColor
+	if color.white {
+		raw = lightColor{white: true, w: cal.encodeChannel(calibrationWhite, color.w)}
+	} else {
+		raw = lightColor{
+			r: cal.encodeChannel(calibrationRed, color.r),
+			g: cal.encodeChannel(calibrationGreen, color.g),
+			b: cal.encodeChannel(calibrationBlue, color.b),
+		}
+	}
+
+	cal.lock.Lock()
+	if raw.white {
+		cal.lastWhite = &calibratedFrame{raw: raw, requested: requested}
+	} else {
+		cal.lastRGB = &calibratedFrame{raw: raw, requested: requested}
+	}
+	cal.lock.Unlock()
+	return raw
+}
+
+// Returns the color the light was asked to show, given the one it reports. Does nothing on a nil *calibration.
+func (cal *calibration) Decode(raw lightColor) lightColor {
+	if cal == nil {
+		return raw
+	}
+
+	cal.lock.Lock()
+	last := cal.lastRGB
+	if raw.white {
+		last = cal.lastWhite
+	}
+	cal.lock.Unlock()
+	if last != nil && last.raw == raw {
+		return last.requested
+	}
+
+	if raw.white {
+		return lightColor{white: true, w: cal.decodeChannel(calibrationWhite, raw.w)}
+	}
+	return lightColor{
+		r: cal.decodeChannel(calibrationRed, raw.r),
+		g: cal.decodeChannel(calibrationGreen, raw.g),
+		b: cal.decodeChannel(calibrationBlue, raw.b),
+	}
+}
+
+// Undoes the calibration of the color of a status. Built-in modes are left alone, the light doesn't know about the
+// calibration.
+func (cal *calibration) DecodeStatus(status *LightStatus) {
+	raw := statusColor(status)
+	if cal == nil || raw == nil {
+		return
+	}
+	color := cal.Decode(*raw)
+	if color.white {
+		status.WarmWhiteIntensity = color.w
+		return
+	}
+	// Shown by the white LEDs because of the white threshold
+	if raw.white {
+		status.WarmWhite = false
+		status.WarmWhiteIntensity = 0
+	}
+	status.R, status.G, status.B = color.r, color.g, color.b
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+)
+
+// Returns the brightness of a color, the value of its brightest channel
+func colorBrightness(color jsonColor) uint8 {
+	brightness := color.R
+	if color.G > brightness {
+		brightness = color.G
+	}
+	if color.B > brightness {
+		brightness = color.B
+	}
+	return brightness
+}
+
+// Scales a color so that its brightest channel is at the given brightness, keeping its hue and saturation. Black has
+// neither, it becomes a gray.
+func scaleColor(color jsonColor, brightness uint8) jsonColor {
+	max := colorBrightness(color)
+	if max == 0 {
+		return jsonColor{R: brightness, G: brightness, B: brightness}
+	}
+	scale := func(channel uint8) uint8 {
+		return uint8(math.Round(float64(channel) * float64(brightness) / float64(max)))
+	}
+	return jsonColor{R: scale(color.R), G: scale(color.G), B: scale(color.B)}
+}
+
+// Returns the hue of a color in degrees, and its saturation and value between 0 and 1
+func rgbToHsv(color jsonColor) (hue float64, saturation float64, value float64) {
+	r, g, b := float64(color.R)/255, float64(color.G)/255, float64(color.B)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	if max > 0 {
+		saturation = delta / max
+	}
+	switch {
+	case delta == 0:
+		hue = 0
+	case max == r:
+		hue = 60 * math.Mod((g-b)/delta, 6)
+	case max == g:
+		hue = 60 * ((b-r)/delta + 2)
+	default:
+		hue = 60 * ((r-g)/delta + 4)
+	}
+	if hue < 0 {
+		hue += 360
+	}
+	return hue, saturation, max
+}
+
+// Returns the color with the given hue in degrees, and saturation and value between 0 and 1
+func hsvToRgb(hue float64, saturation float64, value float64) jsonColor {
+	hue = math.Mod(hue, 360)
+	chroma := value * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := value - chroma
+
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	channel := func(c float64) uint8 {
+		return uint8(math.Round((c + m) * 255))
+	}
+	return jsonColor{R: channel(r), G: channel(g), B: channel(b)}
+}
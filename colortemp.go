@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Defaults of the color_temp settings, in Kelvin
+const (
+	defaultWhiteLEDTemp   = 2700
+	defaultMinColorTemp   = 2000
+	defaultMaxColorTemp   = 6500
+	defaultWhiteTempRange = 300
+)
+
+// Color temperatures commands can ask for, in Kelvin, whatever the settings of the light
+const (
+	minColorTempKelvin = 1000
+	maxColorTempKelvin = 10000
+)
+
+// Frames of a colorMix that make up one cycle, the share of white is rounded to this
+const colorMixCycleFrames = 10
+
+// How a light approximates color temperatures, with the defaults filled in
+type colorTempSettings struct {
+	whiteLED       int
+	min            int
+	max            int
+	whiteRange     int
+	alternateRange int
+}
+
+func getColorTempSettings(deviceConfig *DeviceConfig) *colorTempSettings {
+	settings := &colorTempSettings{
+		whiteLED:   defaultWhiteLEDTemp,
+		min:        defaultMinColorTemp,
+		max:        defaultMaxColorTemp,
+		whiteRange: defaultWhiteTempRange,
+	}
+	config := deviceConfig.ColorTemp
+	if config == nil {
+		return settings
+	}
+	if config.WhiteLED != nil {
+		settings.whiteLED = *config.WhiteLED
+	}
+	if config.Min != nil {
+		settings.min = *config.Min
+	}
+	if config.Max != nil {
+		settings.max = *config.Max
+	}
+	if config.WhiteRange != nil {
+		settings.whiteRange = *config.WhiteRange
+	}
+	if config.AlternateRange != nil {
+		settings.alternateRange = *config.AlternateRange
+	}
+	return settings
+}
+
+func validateColorTempConfig(config *ColorTempConfig) error {
+	settings := getColorTempSettings(&DeviceConfig{ColorTemp: config})
+	for _, temp := range []int{settings.whiteLED, settings.min, settings.max} {
+		if temp < minColorTempKelvin || temp > maxColorTempKelvin {
+			return errors.New(fmt.Sprintf("color temperature %dK is out of range, must be between %dK and %dK",
+				temp, minColorTempKelvin, maxColorTempKelvin))
+		}
+	}
+	if settings.min >= settings.max {
+		return errors.New("color_temp min must be lower than max")
+	}
+	if settings.whiteRange < 0 {
+		return errors.New("color_temp white_range can't be negative")
+	}
+	if settings.alternateRange != 0 && settings.alternateRange <= settings.whiteRange {
+		return errors.New("color_temp alternate_range must be larger than white_range")
+	}
+	return nil
+}
+
+func kelvinToMireds(kelvin int) uint16 {
+	return uint16(math.Round(1e6 / float64(kelvin)))
+}
+
+func miredsToKelvin(mireds uint16) int {
+	return int(math.Round(1e6 / float64(mireds)))
+}
+
+// Parses a color temperature in Kelvin, like '2700K' or '2700', or in mireds, like '370'. Values from 1000 up are taken
+// as Kelvin.
+func ParseColorTempCommand(payload []byte) (*LightCommand, error) {
+	str := strings.TrimSpace(string(payload))
+	kelvin := strings.HasSuffix(strings.ToUpper(str), "K")
+	value, err := strconv.ParseUint(strings.TrimRight(str, "kK"), 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if value >= minColorTempKelvin {
+		kelvin = true
+	}
+	if value == 0 {
+		return nil, errors.New("color temperature can't be 0")
+	}
+
+	mireds := uint16(value)
+	if kelvin {
+		mireds = kelvinToMireds(int(value))
+	}
+	return &LightCommand{State: stringPtr("ON"), ColorTemp: &mireds}, nil
+}
+
+func clampChannel(value float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, value))))
+}
+
+// Returns the color of a black body at the given temperature, at full brightness. It's the usual fit of the CIE 1964
+// color matching functions, good enough for LEDs that are far from calibrated anyway.
+func kelvinToRgb(kelvin int) jsonColor {
+	temp := float64(kelvin) / 100
+	var r, g, b float64
+	if temp <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(temp) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(temp-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(temp-60, -0.0755148492)
+	}
+	switch {
+	case temp >= 66:
+		b = 255
+	case temp <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(temp-10) - 305.0447927307
+	}
+	return scaleColor(jsonColor{R: clampChannel(r), G: clampChannel(g), B: clampChannel(b)}, 255)
+}
+
+// Returns the color temperature, in Kelvin, that the RGB color approximates, if it's one the light would show for a
+// color temperature
+func (settings *colorTempSettings) rgbToKelvin(color jsonColor) (int, bool) {
+	brightness := colorBrightness(color)
+	if brightness == 0 {
+		return 0, false
+	}
+	// Scaling the approximation rounds each channel once more
+	tolerance := colorTolerance + 1
+	matches := func(actual uint8, expected uint8) bool {
+		return int(actual) >= int(expected)-tolerance && int(actual) <= int(expected)+tolerance
+	}
+	best, bestDistance := 0, math.Inf(1)
+	for kelvin := settings.min; kelvin <= settings.max; kelvin += 10 {
+		expected := scaleColor(kelvinToRgb(kelvin), brightness)
+		if !matches(color.R, expected.R) || !matches(color.G, expected.G) || !matches(color.B, expected.B) {
+			continue
+		}
+		distance := math.Abs(float64(color.R)-float64(expected.R)) +
+			math.Abs(float64(color.G)-float64(expected.G)) +
+			math.Abs(float64(color.B)-float64(expected.B))
+		if distance < bestDistance {
+			best, bestDistance = kelvin, distance
+		}
+	}
+	return best, best != 0
+}
+
+// Returns the color temperature, in Kelvin, that a light in the given status shows, if it shows one
+func (settings *colorTempSettings) statusKelvin(status *LightStatus) (int, bool) {
+	if status.Mode != "control" {
+		return 0, false
+	}
+	if status.WarmWhite {
+		return settings.whiteLED, true
+	}
+	return settings.rgbToKelvin(jsonColor{R: status.R, G: status.G, B: status.B})
+}
+
+// Alternation between the white LEDs and an RGB color, to show a color temperature neither gets close to alone
+type colorMix struct {
+	white lightColor
+	rgb   lightColor
+	// Frames out of colorMixCycleFrames that show the white LEDs
+	whiteFrames int
+}
+
+// Returns the frame of the mix with the given index. The white frames are spread over the cycle as evenly as possible,
+// so the alternation is as fast as the light can take.
+func (mix *colorMix) frame(index int) lightColor {
+	index %= colorMixCycleFrames
+	if (index+1)*mix.whiteFrames/colorMixCycleFrames > index*mix.whiteFrames/colorMixCycleFrames {
+		return mix.white
+	}
+	return mix.rgb
+}
+
+// Returns what shows the color temperature, in mireds, at the given brightness: either the white LEDs, an RGB color
+// or, if neither gets close enough, a mix of the two
+func (settings *colorTempSettings) resolve(mireds uint16, brightness uint8) (lightColor, *colorMix) {
+	kelvin := miredsToKelvin(mireds)
+	if kelvin < settings.min {
+		kelvin = settings.min
+	} else if kelvin > settings.max {
+		kelvin = settings.max
+	}
+	white := lightColor{white: true, w: brightness}
+	rgbAt := func(kelvin int) lightColor {
+		color := scaleColor(kelvinToRgb(kelvin), brightness)
+		return lightColor{r: color.R, g: color.G, b: color.B}
+	}
+
+	distance := kelvin - settings.whiteLED
+	if distance < 0 {
+		distance = -distance
+	}
+	if distance <= settings.whiteRange {
+		return white, nil
+	}
+	if distance >= settings.alternateRange {
+		return rgbAt(kelvin), nil
+	}
+
+	// The RGB LEDs show the temperature at the edge of the alternate range, or of the range of the light if that comes
+	// first, the further the requested one is from the white LEDs the longer they're on
+	edge := settings.whiteLED + settings.alternateRange
+	if edge > settings.max {
+		edge = settings.max
+	}
+	if kelvin < settings.whiteLED {
+		edge = settings.whiteLED - settings.alternateRange
+		if edge < settings.min {
+			edge = settings.min
+		}
+	}
+	edgeDistance := edge - settings.whiteLED
+	if edgeDistance < 0 {
+		edgeDistance = -edgeDistance
+	}
+	if distance >= edgeDistance {
+		return rgbAt(kelvin), nil
+	}
+	rgbShare := float64(distance-settings.whiteRange) / float64(edgeDistance-settings.whiteRange)
+	whiteFrames := int(math.Round((1 - rgbShare) * colorMixCycleFrames))
+	switch whiteFrames {
+	case 0:
+		return rgbAt(edge), nil
+	case colorMixCycleFrames:
+		return white, nil
+	}
+	return white, &colorMix{white: white, rgb: rgbAt(edge), whiteFrames: whiteFrames}
+}
@@ -1,25 +1,86 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
 )
 
+var macAddressRegexp = regexp.MustCompile(`^([0-9A-F]{2}:){5}[0-9A-F]{2}$`)
+
+// Topics right under the global mountpoint that devices can't use as their mountpoint
+var reservedMountpoints = []string{"online", "bridge"}
+
 type Config struct {
-	Bluetooth *BluetoothConfig        `yaml:"bluetooth,omitempty"`
-	MQTT      MQTTConfig              `yaml:"mqtt"`
-	Devices   map[string]DeviceConfig `yaml:"devices"`
+	Bluetooth     *BluetoothConfig        `yaml:"bluetooth,omitempty"`
+	MQTT          MQTTConfig              `yaml:"mqtt"`
+	HomeAssistant *HomeAssistantConfig    `yaml:"homeassistant,omitempty"`
+	HTTP          *HTTPConfig             `yaml:"http,omitempty"`
+	Logging       *LoggingConfig          `yaml:"logging,omitempty"`
+	StateFile     *string                 `yaml:"state_file,omitempty"`
+	Devices       map[string]DeviceConfig `yaml:"devices"`
 }
 
 type TLSConfig struct {
-	InsecureSkipVerify bool `yaml:"insecure,omitempty"`
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// Old name of insecure_skip_verify, still accepted
+	Insecure   bool    `yaml:"insecure,omitempty"`
+	CAFile     *string `yaml:"ca_file,omitempty"`
+	CertFile   *string `yaml:"cert_file,omitempty"`
+	KeyFile    *string `yaml:"key_file,omitempty"`
+	ServerName *string `yaml:"server_name,omitempty"`
+	MinVersion *string `yaml:"min_version,omitempty"`
 }
 
 type DeviceConfig struct {
-	MountPoint           string   `yaml:"mountpoint"`
-	RGBCharacteristic    *string  `yaml:"rgb_characteristic,omitempty"`
-	NotifyCharacteristic *string  `yaml:"notify_characteristic,omitempty"`
-	ReadStatusInterval   *float64 `yaml:"read_status_interval,omitempty"`
+	MountPoint                 string             `yaml:"mountpoint"`
+	RGBCharacteristic          *string            `yaml:"rgb_characteristic,omitempty"`
+	NotifyCharacteristic       *string            `yaml:"notify_characteristic,omitempty"`
+	ReadStatusInterval         *float64           `yaml:"read_status_interval,omitempty"`
+	ReadStatusIntervalAnimated *float64           `yaml:"read_status_interval_animated,omitempty"`
+	MinWriteInterval           *float64           `yaml:"min_write_interval,omitempty"`
+	PowerOnBehavior            *string            `yaml:"power_on_behavior,omitempty"`
+	ExternalChanges            *string            `yaml:"external_changes,omitempty"`
+	ColorTemp                  *ColorTempConfig   `yaml:"color_temp,omitempty"`
+	Calibration                *CalibrationConfig `yaml:"calibration,omitempty"`
+}
+
+// How the colors sent to a light are corrected so they look like they should
+type CalibrationConfig struct {
+	// Exponent each channel is raised to, default 1
+	Gamma *CalibrationChannels `yaml:"gamma,omitempty"`
+	// Relative gains of the RGB channels that make 255,255,255 look white, default 1
+	WhiteBalance *CalibrationChannels `yaml:"white_balance,omitempty"`
+	// Value sent for each channel at full brightness, default 255
+	Max *CalibrationChannels `yaml:"max,omitempty"`
+	// RGB colors with up to this saturation, in percent, are shown by the white LEDs
+	WhiteThreshold *float64 `yaml:"white_threshold,omitempty"`
+}
+
+// Values for the red, green, blue and warm white channels
+type CalibrationChannels struct {
+	R *float64 `yaml:"r,omitempty"`
+	G *float64 `yaml:"g,omitempty"`
+	B *float64 `yaml:"b,omitempty"`
+	W *float64 `yaml:"w,omitempty"`
+}
+
+// How color temperatures are shown, all in Kelvin
+type ColorTempConfig struct {
+	// Color temperature of the warm white LEDs
+	WhiteLED *int `yaml:"white_led,omitempty"`
+	// Range Home Assistant offers, requests outside of it are clamped
+	Min *int `yaml:"min,omitempty"`
+	Max *int `yaml:"max,omitempty"`
+	// Temperatures this close to the white LEDs' are shown by them alone
+	WhiteRange *int `yaml:"white_range,omitempty"`
+	// Temperatures beyond white_range and up to this far from the white LEDs' alternate them with the RGB LEDs, 0
+	// disables it
+	AlternateRange *int `yaml:"alternate_range,omitempty"`
 }
 
 type BluetoothConfig struct {
@@ -28,12 +89,30 @@ type BluetoothConfig struct {
 }
 
 type MQTTConfig struct {
-	MountPoint *string    `yaml:"mountpoint,omitempty"`
-	Servers    []string   `yaml:"servers"`
-	ClientID   *string    `yaml:"client_id,omitempty"`
-	Username   *string    `yaml:"username,omitempty"`
-	Password   *string    `yaml:"password,omitempty"`
-	TLS        *TLSConfig `yaml:"tls,omitempty"`
+	MountPoint   *string    `yaml:"mountpoint,omitempty"`
+	Servers      []string   `yaml:"servers"`
+	ClientID     *string    `yaml:"client_id,omitempty"`
+	Username     *string    `yaml:"username,omitempty"`
+	Password     *string    `yaml:"password,omitempty"`
+	PasswordFile *string    `yaml:"password_file,omitempty"`
+	TLS          *TLSConfig `yaml:"tls,omitempty"`
+}
+
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type LoggingConfig struct {
+	Level *string `yaml:"level,omitempty"`
+	// Levels of single subsystems, overriding the global one
+	Subsystems    map[string]string `yaml:"subsystems,omitempty"`
+	Format        *string           `yaml:"format,omitempty"`
+	ForwardToMQTT bool              `yaml:"forward_to_mqtt,omitempty"`
+}
+
+type HomeAssistantConfig struct {
+	Discovery       bool    `yaml:"discovery"`
+	DiscoveryPrefix *string `yaml:"discovery_prefix,omitempty"`
 }
 
 func UnmarshalConfig(yml []byte, config *Config) (err error) {
@@ -50,3 +129,94 @@ func ReadConfig(path string) (config Config, err error) {
 	err = UnmarshalConfig(content, &config)
 	return
 }
+
+// Checks the parts of the config that can't be checked by just unmarshalling it
+func ValidateConfig(config *Config) error {
+	if len(config.MQTT.Servers) == 0 {
+		return errors.New("no MQTT servers configured")
+	}
+	if config.MQTT.TLS != nil {
+		if _, err := NewTLSConfig(config.MQTT.TLS); err != nil {
+			return errors.New(fmt.Sprintf("invalid TLS settings: %v", err))
+		}
+	}
+	if _, _, err := getCredentials(&config.MQTT); err != nil {
+		return errors.New(fmt.Sprintf("unable to read MQTT credentials: %v", err))
+	}
+	if config.HTTP != nil && config.HTTP.Listen == "" {
+		return errors.New("no address to listen on for HTTP")
+	}
+	if config.Logging != nil {
+		if err := validateLoggingConfig(config.Logging); err != nil {
+			return err
+		}
+	}
+	for addr, deviceConfig := range config.Devices {
+		if err := validateDeviceAddress(addr); err != nil {
+			return err
+		}
+		// Config files from before mountpoints were checked keep working, only devices added or renamed through
+		// MQTT are rejected
+		if err := validateMountpoint(deviceConfig.MountPoint, addr, config.Devices); err != nil {
+			log.Warningf("mountpoint of device '%s' may clash with other topics: %v", addr, err)
+		}
+		if deviceConfig.PowerOnBehavior != nil {
+			if _, _, err := ParsePowerOnBehavior(*deviceConfig.PowerOnBehavior); err != nil {
+				return errors.New(fmt.Sprintf("device '%s': %v", addr, err))
+			}
+		}
+		if deviceConfig.ExternalChanges != nil {
+			if err := validateExternalChanges(*deviceConfig.ExternalChanges); err != nil {
+				return errors.New(fmt.Sprintf("device '%s': %v", addr, err))
+			}
+		}
+		if deviceConfig.ColorTemp != nil {
+			if err := validateColorTempConfig(deviceConfig.ColorTemp); err != nil {
+				return errors.New(fmt.Sprintf("device '%s': %v", addr, err))
+			}
+		}
+		if deviceConfig.Calibration != nil {
+			if err := validateCalibrationConfig(deviceConfig.Calibration); err != nil {
+				return errors.New(fmt.Sprintf("device '%s': %v", addr, err))
+			}
+		}
+	}
+	return nil
+}
+
+func validateDeviceAddress(addr string) error {
+	if !macAddressRegexp.MatchString(strings.ToUpper(addr)) {
+		return errors.New(fmt.Sprintf("'%s' is not a valid MAC address", addr))
+	}
+	return nil
+}
+
+// Checks that the mountpoint can be used by the given device without clashing with the other devices' topics
+func validateMountpoint(mountpoint string, addr string, devices map[string]DeviceConfig) error {
+	if strings.ContainsAny(mountpoint, "+#\x00") {
+		return errors.New("mountpoint can't contain MQTT wildcards or NUL characters")
+	}
+	// Same as what path.Join() does with it, relative to the global mountpoint
+	cleaned := strings.TrimPrefix(path.Clean("/"+mountpoint), "/")
+	if cleaned == "" {
+		return errors.New("mountpoint can't be empty")
+	}
+	for _, reserved := range reservedMountpoints {
+		if cleaned == reserved || strings.HasPrefix(cleaned, reserved+"/") {
+			return errors.New(fmt.Sprintf("mountpoint '%s' is reserved", reserved))
+		}
+	}
+
+	for other, deviceConfig := range devices {
+		if strings.EqualFold(other, addr) {
+			continue
+		}
+		otherCleaned := strings.TrimPrefix(path.Clean("/"+deviceConfig.MountPoint), "/")
+		if cleaned == otherCleaned ||
+			strings.HasPrefix(cleaned, otherCleaned+"/") ||
+			strings.HasPrefix(otherCleaned, cleaned+"/") {
+			return errors.New(fmt.Sprintf("mountpoint overlaps with the one of device '%s'", other))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const defaultConfigIndent = 2
+
+var (
+	devicesKeyRegexp    = regexp.MustCompile(`^devices\s*:(.*)$`)
+	deviceEntryRegexp   = regexp.MustCompile(`^\s*['"]?([0-9A-Fa-f:]+)['"]?\s*:\s*(#.*)?$`)
+	mountpointKeyRegexp = regexp.MustCompile(`^(\s*)mountpoint\s*:(.*)$`)
+)
+
+// Edits the devices section of a YAML config file in place.
+//
+// yaml.v2 loses comments and formatting when a document is unmarshalled and marshalled again, and people's config
+// files are full of commented out examples, so the file is edited line by line instead. Only the lines of the device
+// being changed are touched. Before saving, the result is parsed again and compared with what it is supposed to
+// contain, so anything this doesn't understand makes the edit fail rather than mangling the file.
+type configFile struct {
+	path  string
+	lines []string
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &configFile{
+		path:  path,
+		lines: strings.Split(string(content), "\n"),
+	}, nil
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// Lines that aren't blank or comments
+func isContentLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed != "" && !strings.HasPrefix(trimmed, "#")
+}
+
+func quoteYAMLString(str string) string {
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
+
+// Splits a YAML scalar from the comment following it, if any
+func splitYAMLComment(value string) (scalar string, comment string) {
+	var quote rune
+	for i, char := range value {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"':
+			quote = char
+		case char == '#' && (i == 0 || value[i-1] == ' ' || value[i-1] == '\t'):
+			return strings.TrimSpace(value[:i]), value[i:]
+		}
+	}
+	return strings.TrimSpace(value), ""
+}
+
+// Returns the index of the "devices:" line and the index right after the last line of the section that isn't blank
+// or a comment, so comments right above the next section stay with it.
+func (file *configFile) devicesSection() (start int, end int, err error) {
+	start = -1
+	for i, line := range file.lines {
+		match := devicesKeyRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		value, _ := splitYAMLComment(match[1])
+		switch value {
+		case "":
+		case "{}", "~", "null":
+			// Empty, turn it into a block so devices can be added to it
+			file.lines[i] = "devices:"
+		default:
+			return 0, 0, errors.New("'devices' must be written in block style to be edited")
+		}
+		start = i
+		break
+	}
+
+	if start < 0 {
+		// Not there at all, add it at the end
+		for len(file.lines) > 0 && strings.TrimSpace(file.lines[len(file.lines)-1]) == "" {
+			file.lines = file.lines[:len(file.lines)-1]
+		}
+		file.lines = append(file.lines, "devices:", "")
+		start = len(file.lines) - 2
+	}
+
+	end = start + 1
+	for i := start + 1; i < len(file.lines); i++ {
+		line := file.lines[i]
+		if !isContentLine(line) {
+			continue
+		}
+		if indentOf(line) == 0 {
+			break
+		}
+		end = i + 1
+	}
+	return
+}
+
+// Indentation of the device entries and of their fields, guessed from the existing ones
+func (file *configFile) devicesIndent(start int, end int) (entryIndent int, fieldIndent int) {
+	entryIndent, fieldIndent = -1, -1
+	for i := start + 1; i < end; i++ {
+		line := file.lines[i]
+		if !isContentLine(line) {
+			continue
+		}
+		indent := indentOf(line)
+		if entryIndent < 0 {
+			entryIndent = indent
+		} else if indent > entryIndent {
+			fieldIndent = indent
+			break
+		}
+	}
+	if entryIndent < 0 {
+		entryIndent = defaultConfigIndent
+	}
+	if fieldIndent < 0 {
+		fieldIndent = entryIndent + defaultConfigIndent
+	}
+	return
+}
+
+// Returns the first line of the device's entry and the index right after its last line that isn't blank or a comment
+func (file *configFile) deviceEntry(addr string) (entryStart int, entryEnd int, err error) {
+	start, end, err := file.devicesSection()
+	if err != nil {
+		return 0, 0, err
+	}
+	entryIndent, _ := file.devicesIndent(start, end)
+
+	entryStart = -1
+	for i := start + 1; i < end; i++ {
+		line := file.lines[i]
+		if !isContentLine(line) {
+			continue
+		}
+		if indentOf(line) <= entryIndent && entryStart >= 0 {
+			break
+		}
+		if entryStart >= 0 {
+			entryEnd = i + 1
+			continue
+		}
+		if indentOf(line) != entryIndent {
+			continue
+		}
+		if match := deviceEntryRegexp.FindStringSubmatch(line); match != nil && strings.EqualFold(match[1], addr) {
+			entryStart = i
+			entryEnd = i + 1
+		}
+	}
+	if entryStart < 0 {
+		return 0, 0, errors.New(fmt.Sprintf("device '%s' not found in config file", addr))
+	}
+	return
+}
+
+func (file *configFile) AddDevice(addr string, deviceConfig DeviceConfig) error {
+	start, end, err := file.devicesSection()
+	if err != nil {
+		return err
+	}
+	entryIndent, fieldIndent := file.devicesIndent(start, end)
+
+	entry := []string{
+		strings.Repeat(" ", entryIndent) + quoteYAMLString(addr) + ":",
+		strings.Repeat(" ", fieldIndent) + "mountpoint: " + quoteYAMLString(deviceConfig.MountPoint),
+	}
+	file.lines = append(file.lines[:end], append(entry, file.lines[end:]...)...)
+	return nil
+}
+
+func (file *configFile) RemoveDevice(addr string) error {
+	entryStart, entryEnd, err := file.deviceEntry(addr)
+	if err != nil {
+		return err
+	}
+	file.lines = append(file.lines[:entryStart], file.lines[entryEnd:]...)
+	return nil
+}
+
+func (file *configFile) SetDeviceMountpoint(addr string, mountpoint string) error {
+	entryStart, entryEnd, err := file.deviceEntry(addr)
+	if err != nil {
+		return err
+	}
+	for i := entryStart + 1; i < entryEnd; i++ {
+		match := mountpointKeyRegexp.FindStringSubmatch(file.lines[i])
+		if match == nil {
+			continue
+		}
+		_, comment := splitYAMLComment(match[2])
+		line := match[1] + "mountpoint: " + quoteYAMLString(mountpoint)
+		if comment != "" {
+			// Keep the comment in the same column, if it still fits
+			column := len(file.lines[i]) - len(comment)
+			padding := column - len(line)
+			if padding < 1 {
+				padding = 1
+			}
+			line += strings.Repeat(" ", padding) + comment
+		}
+		file.lines[i] = line
+		return nil
+	}
+	return errors.New(fmt.Sprintf("mountpoint of device '%s' not found in config file", addr))
+}
+
+// Checks that the edited file contains exactly the given devices, then replaces the file atomically
+func (file *configFile) Save(devices map[string]DeviceConfig) error {
+	content := []byte(strings.Join(file.lines, "\n"))
+
+	var config Config
+	if err := UnmarshalConfig(content, &config); err != nil {
+		return errors.New(fmt.Sprintf("edited config file is not valid anymore: %v", err))
+	}
+	if len(config.Devices) != len(devices) || (len(devices) > 0 && !reflect.DeepEqual(config.Devices, devices)) {
+		return errors.New("unable to edit the devices in the config file safely, please edit it by hand")
+	}
+
+	return writeFileAtomic(file.path, content)
+}
+
+// Writes to a temporary file next to the target, then renames it over the target, so the file is never left
+// half-written. The target keeps its permissions, if it doesn't exist yet it's created readable by everyone.
+func writeFileAtomic(path string, content []byte) error {
+	// Replace the file a symlink points to, rather than the symlink
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	renamed = true
+
+	// Make the rename itself durable
+	if dirFile, err := os.Open(dir); err == nil {
+		_ = dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
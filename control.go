@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Depau/consmart-ble-mqtt/triones"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Speed used when a mode is set without specifying it
+const defaultModeSpeed uint8 = 10
+
+type jsonColor struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+// Command to change the state of a light. Only the fields that are set are changed.
+//
+// This is what the control/set topic takes, it is compatible with Home Assistant's JSON schema. The other control
+// topics are translated to it.
+type LightCommand struct {
+	State  *string    `json:"state,omitempty"`
+	Color  *jsonColor `json:"color,omitempty"`
+	White  *uint8     `json:"white,omitempty"`
+	Effect *string    `json:"effect,omitempty"`
+	Speed  *uint8     `json:"speed,omitempty"`
+	// Color temperature in mireds, like Home Assistant sends it
+	ColorTemp *uint16 `json:"color_temp,omitempty"`
+	// Brightness of the color, the white LEDs or the color temperature, 0-255. Without any of them, the color the light
+	// shows is dimmed or brightened keeping its hue.
+	Brightness *uint8 `json:"brightness,omitempty"`
+	// Seconds to fade the color, white or power change over. Ignored with effects.
+	Transition *float64 `json:"transition,omitempty"`
+}
+
+func (command *LightCommand) Validate() error {
+	if command.State != nil && *command.State != "ON" && *command.State != "OFF" {
+		return errors.New(fmt.Sprintf("invalid state '%s', must be 'ON' or 'OFF'", *command.State))
+	}
+
+	set := 0
+	for _, isSet := range []bool{
+		command.Color != nil, command.White != nil, command.Effect != nil, command.ColorTemp != nil,
+	} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("only one of 'color', 'white', 'effect' and 'color_temp' can be set")
+	}
+	if command.ColorTemp != nil {
+		if kelvin := miredsToKelvin(*command.ColorTemp); kelvin < minColorTempKelvin || kelvin > maxColorTempKelvin {
+			return errors.New(fmt.Sprintf("color_temp must be between %d and %d mireds",
+				kelvinToMireds(maxColorTempKelvin), kelvinToMireds(minColorTempKelvin)))
+		}
+	}
+
+	if command.Effect != nil {
+		if mode, ok := triones.ModeByName(*command.Effect); !ok || !mode.IsBuiltIn() {
+			return errors.New(fmt.Sprintf("effect '%s' is not valid", *command.Effect))
+		}
+	}
+	if command.Speed != nil {
+		if command.Effect == nil {
+			return errors.New("'speed' can only be set together with 'effect'")
+		}
+		if *command.Speed > triones.MaxSpeed || *command.Speed < triones.MinSpeed {
+			return errors.New("speed must be between 1 and 31 (and is inversely proportional)")
+		}
+	}
+	if command.Brightness != nil && command.Effect != nil {
+		return errors.New("'brightness' can't be set together with 'effect'")
+	}
+	if command.Transition != nil && (*command.Transition < 0 || *command.Transition > maxTransition.Seconds()) {
+		return errors.New(fmt.Sprintf("transition must be between 0 and %.0f seconds", maxTransition.Seconds()))
+	}
+	return nil
+}
+
+// Returns how long the command has to be faded over, 0 if it's applied right away
+func (command *LightCommand) TransitionDuration() time.Duration {
+	// The light runs effects on its own
+	if command.Transition == nil || command.Effect != nil {
+		return 0
+	}
+	return time.Duration(*command.Transition * float64(time.Second))
+}
+
+// Changes the command so that applying it has the same effect as applying it and then the newer one. Transitions are
+// not kept, only where they lead.
+func (command *LightCommand) Merge(newer *LightCommand) {
+	if newer.State != nil {
+		command.State = newer.State
+	}
+	// The light can only show one of them at a time
+	if newer.Color != nil || newer.White != nil || newer.Effect != nil || newer.ColorTemp != nil {
+		command.Color = newer.Color
+		command.White = newer.White
+		command.Effect = newer.Effect
+		command.Speed = newer.Speed
+		command.ColorTemp = newer.ColorTemp
+		command.Brightness = newer.Brightness
+	}
+}
+
+// Returns what to do when the bridge connects to a light, given its power_on_behavior: whether the last commanded
+// state has to be restored, or the command to apply instead
+func ParsePowerOnBehavior(behavior string) (restore bool, command *LightCommand, err error) {
+	switch behavior {
+	case "restore":
+		return true, nil, nil
+	case "on", "off":
+		command, err = ParsePowerCommand([]byte(behavior))
+		return false, command, err
+	}
+	if command, err = ParseColorCommand([]byte(behavior)); err != nil {
+		return false, nil, errors.New(fmt.Sprintf("invalid power_on_behavior '%s', must be restore, on, off or "+
+			"a color like 255,200,100", behavior))
+	}
+	return false, command, nil
+}
+
+// Applies commands to a light. Commands are applied one at a time, so the writes of different commands are never
+// interleaved, no matter which topic they came from.
+//
+// Commands that come from the control topics are recorded as the last commanded state of the light, which can be
+// restored when the bridge connects to it again. All the commands are handed to the reconciler, if any, so it can
+// check that the light applies them.
+//
+// Commands with a transition are handed to the fader, which a new command interrupts, and so are color temperatures
+// that are shown by alternating the white and the RGB LEDs.
+type lightController struct {
+	light      BleLight
+	poller     *statusPoller
+	fader      *fader
+	temps      *colorTempSettings
+	addr       string
+	states     *stateStore
+	reconciler *reconciler
+	lock       *sync.Mutex
+	// RGB color, at full brightness, the light was last set to. Brightness changes scale it rather than what the light
+	// shows, whose hue gets lost in rounding at low brightness.
+	fullColor *jsonColor
+}
+
+func newLightController(
+	light BleLight,
+	poller *statusPoller,
+	fader *fader,
+	temps *colorTempSettings,
+	addr string,
+	states *stateStore,
+	reconciler *reconciler,
+) *lightController {
+	return &lightController{
+		light:      light,
+		poller:     poller,
+		fader:      fader,
+		temps:      temps,
+		addr:       addr,
+		states:     states,
+		reconciler: reconciler,
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Applies a command from the control topics
+func (controller *lightController) Apply(command *LightCommand) error {
+	if err := command.Validate(); err != nil {
+		return err
+	}
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	command, err := controller.resolveBrightness(command)
+	if err != nil {
+		return err
+	}
+	if err := controller.apply(command); err != nil {
+		return err
+	}
+	// Only commands that were queued for writing are restored and checked against the status. The lock is still held,
+	// so no status is checked against the desired state from before this command.
+	controller.states.Record(controller.addr, command)
+	controller.reconciler.Desire(command)
+	return nil
+}
+
+// Applies the power_on_behavior of the light, which is expected to be valid, right after connecting to it. Returns
+// the command that was applied, nil if there was nothing to do.
+func (controller *lightController) ApplyPowerOnBehavior(behavior string) (*LightCommand, error) {
+	restore, command, _ := ParsePowerOnBehavior(behavior)
+	if restore {
+		command = controller.states.Commanded(controller.addr)
+	}
+	if command == nil {
+		return nil, nil
+	}
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	if err := controller.apply(command); err != nil {
+		return command, err
+	}
+	controller.reconciler.Desire(command)
+	return command, nil
+}
+
+// Returns the brightness of what the light shows, full brightness if it's not known
+func (controller *lightController) shownBrightness() uint8 {
+	shown, _ := controller.fader.Shown()
+	switch {
+	case shown == nil:
+		return 255
+	case shown.white && shown.w > 0:
+		return shown.w
+	case !shown.white && (shown.r > 0 || shown.g > 0 || shown.b > 0):
+		return colorBrightness(jsonColor{R: shown.r, G: shown.g, B: shown.b})
+	}
+	return 255
+}
+
+// Returns the command with the brightness turned into the color or white intensity it leads to. Color temperatures
+// keep theirs, so they can be shown at it in any way; without one, they get the brightness the light has. Brightness 0
+// turns the light off.
+func (controller *lightController) resolveBrightness(command *LightCommand) (*LightCommand, error) {
+	if command.Brightness == nil {
+		if command.ColorTemp == nil {
+			return command, nil
+		}
+		resolved := *command
+		brightness := controller.shownBrightness()
+		resolved.Brightness = &brightness
+		return &resolved, nil
+	}
+	brightness := *command.Brightness
+	resolved := *command
+	resolved.Brightness = nil
+
+	if brightness == 0 {
+		return &LightCommand{State: stringPtr("OFF"), Transition: command.Transition}, nil
+	}
+	switch {
+	case command.ColorTemp != nil:
+		return command, nil
+	case command.White != nil:
+		resolved.White = &brightness
+	case command.Color != nil:
+		color := scaleColor(*command.Color, brightness)
+		resolved.Color = &color
+	default:
+		if colorTemp := controller.fader.ColorTemp(); colorTemp != nil {
+			resolved.ColorTemp = colorTemp
+			resolved.Brightness = &brightness
+			break
+		}
+		shown, _ := controller.fader.Shown()
+		if shown == nil {
+			return nil, errors.New("unable to change brightness, the light is not showing a color")
+		}
+		if shown.white {
+			resolved.White = &brightness
+		} else {
+			color := scaleColor(controller.undimmedColor(*shown), brightness)
+			resolved.Color = &color
+		}
+	}
+	return &resolved, nil
+}
+
+// Returns the color at full brightness the light shows a dimmed version of. That's the last one it was set to, unless
+// something else changed it since. Must be called with the lock held.
+func (controller *lightController) undimmedColor(shown lightColor) jsonColor {
+	color := jsonColor{R: shown.r, G: shown.g, B: shown.b}
+	if full := controller.fullColor; full != nil {
+		scaled := scaleColor(*full, colorBrightness(color))
+		if shown.near(lightColor{r: scaled.R, g: scaled.G, b: scaled.B}) {
+			return *full
+		}
+	}
+	return color
+}
+
+// Records the color at full brightness of what the command sets the light to. Must be called with the lock held.
+func (controller *lightController) setFullColor(command *LightCommand) {
+	switch {
+	case command.Color != nil:
+		color := *command.Color
+		// Black has no hue, and dimmed versions of the last color keep it
+		if colorBrightness(color) == 0 {
+			return
+		}
+		if full := controller.fullColor; full != nil && scaleColor(*full, colorBrightness(color)) == color {
+			return
+		}
+		full := scaleColor(color, 255)
+		controller.fullColor = &full
+	case command.White != nil || command.Effect != nil:
+		controller.fullColor = nil
+	}
+}
+
+// Lets the controller know what the light reported, so transitions start from what it shows
+func (controller *lightController) StatusReceived(status *LightStatus) {
+	controller.fader.StatusReceived(status)
+}
+
+// Sends a command to the light. Must be called with the lock held.
+func (controller *lightController) apply(command *LightCommand) error {
+	// Read back the status once the command went through
+	defer controller.poller.Kick()
+
+	// Whatever was fading is superseded
+	controller.fader.Cancel()
+	colorTemp := command.ColorTemp
+	command, mix := controller.resolveColorTemp(command)
+
+	var err error
+	switch duration := command.TransitionDuration(); {
+	case mix != nil:
+		err = controller.applyMix(command, mix)
+	case duration > 0:
+		err = controller.applyTransition(command, duration)
+	default:
+		err = controller.applyNow(command)
+	}
+	if command.Color != nil || command.White != nil || command.Effect != nil {
+		controller.fader.SetColorTemp(colorTemp)
+	}
+	if err == nil {
+		controller.setFullColor(command)
+	}
+	return err
+}
+
+// Returns the command with the color temperature turned into the white or RGB color that shows it, and the mix to
+// start if it's shown by alternating them
+func (controller *lightController) resolveColorTemp(command *LightCommand) (*LightCommand, *colorMix) {
+	if command.ColorTemp == nil {
+		return command, nil
+	}
+	brightness := uint8(255)
+	if command.Brightness != nil {
+		brightness = *command.Brightness
+	}
+	color, mix := controller.temps.resolve(*command.ColorTemp, brightness)
+
+	resolved := *command
+	resolved.ColorTemp = nil
+	resolved.Brightness = nil
+	if color.white {
+		resolved.White = &color.w
+	} else {
+		resolved.Color = &jsonColor{R: color.r, G: color.g, B: color.b}
+	}
+	return &resolved, mix
+}
+
+// Shows the white half of the mix and starts alternating it with the RGB one. Transitions can't be done with mixes,
+// the alternation starts right away.
+func (controller *lightController) applyMix(command *LightCommand, mix *colorMix) error {
+	if err := controller.applyNow(command); err != nil {
+		return err
+	}
+	// Nothing to alternate while the light is off
+	if _, on := controller.fader.Shown(); on {
+		controller.fader.StartMix(mix)
+	}
+	return nil
+}
+
+func (controller *lightController) applyNow(command *LightCommand) error {
+	light := controller.light
+	shown, on := controller.fader.Shown()
+
+	if command.State != nil {
+		on = *command.State == "ON"
+		if !on {
+			controller.fader.Sent(shown, on)
+			return light.SetPower(false)
+		}
+		if err := light.SetPower(true); err != nil {
+			withFields(bleLog, "address", controller.addr).Error("unable to turn on light: ", err)
+			// The light may be on already, the rest of the command can still go through
+		}
+	}
+
+	switch {
+	case command.Effect != nil:
+		speed := defaultModeSpeed
+		if command.Speed != nil {
+			speed = *command.Speed
+		}
+		controller.fader.Sent(nil, on)
+		return light.SetMode(*command.Effect, speed)
+	case command.White != nil:
+		shown = &lightColor{white: true, w: *command.White}
+	case command.Color != nil:
+		shown = &lightColor{r: command.Color.R, g: command.Color.G, b: command.Color.B}
+	default:
+		controller.fader.Sent(shown, on)
+		return nil
+	}
+	controller.fader.Sent(shown, on)
+	return shown.send(light)
+}
+
+// Fades from what the light shows to what the command asks for. Fading in from off starts from black, and so does
+// switching between the RGB and the white LEDs.
+func (controller *lightController) applyTransition(command *LightCommand, duration time.Duration) error {
+	light := controller.light
+	shown, on := controller.fader.Shown()
+
+	var target lightColor
+	switch {
+	case command.White != nil:
+		target = lightColor{white: true, w: *command.White}
+	case command.Color != nil:
+		target = lightColor{r: command.Color.R, g: command.Color.G, b: command.Color.B}
+	case shown != nil:
+		target = *shown
+	default:
+		// Nothing known to fade from or to
+		return controller.applyNow(command)
+	}
+
+	if command.State != nil && *command.State == "OFF" {
+		if !on || shown == nil {
+			return controller.applyNow(command)
+		}
+		controller.fader.Start(&transition{
+			from:     *shown,
+			to:       shown.black(),
+			duration: duration,
+			powerOff: true,
+			restore:  *shown,
+		})
+		return nil
+	}
+
+	turnOn := command.State != nil && !on
+	if !on && !turnOn {
+		// Nothing to see while the light is off
+		return controller.applyNow(command)
+	}
+
+	from := target.black()
+	if !turnOn && shown != nil && shown.white == target.white {
+		from = *shown
+	}
+	if turnOn {
+		if err := from.send(light); err != nil {
+			return err
+		}
+		if err := light.SetPower(true); err != nil {
+			return err
+		}
+	}
+	controller.fader.Sent(&from, true)
+	controller.fader.Start(&transition{from: from, to: target, duration: duration})
+	return nil
+}
+
+func ParseJSONCommand(payload []byte) (*LightCommand, error) {
+	command := &LightCommand{}
+	if err := json.Unmarshal(payload, command); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// Parses an 'R,G,B' color. A color with no saturation selects the white LEDs, black turns the light off.
+func ParseColorCommand(payload []byte) (*LightCommand, error) {
+	color, err := numberStringToUInt8Slice(string(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(color) != 3 {
+		return nil, errors.New(fmt.Sprintf("invalid color length: %d", len(color)))
+	}
+	return makeColorCommand(color[0], color[1], color[2]), nil
+}
+
+// Parses an 'H,S,V' color, with the hue in degrees and the saturation and value in percent. Like with ParseColorCommand,
+// a color with no saturation selects the white LEDs and black turns the light off.
+func ParseHSVCommand(payload []byte) (*LightCommand, error) {
+	values := strings.Split(string(payload), ",")
+	if len(values) != 3 {
+		return nil, errors.New(fmt.Sprintf("invalid color length: %d", len(values)))
+	}
+	var hsv [3]float64
+	for i, value := range values {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, err
+		}
+		hsv[i] = parsed
+	}
+	if hsv[0] < 0 || hsv[0] > 360 {
+		return nil, errors.New(fmt.Sprintf("hue must be between 0 and 360, not %g", hsv[0]))
+	}
+	if hsv[1] < 0 || hsv[1] > 100 || hsv[2] < 0 || hsv[2] > 100 {
+		return nil, errors.New("saturation and value must be between 0 and 100")
+	}
+	color := hsvToRgb(hsv[0], hsv[1]/100, hsv[2]/100)
+	return makeColorCommand(color.R, color.G, color.B), nil
+}
+
+// Parses a brightness, either 0-255 or a percentage like '30%'. Brightness 0 turns the light off.
+func ParseBrightnessCommand(payload []byte) (*LightCommand, error) {
+	str := strings.TrimSpace(string(payload))
+	var brightness uint8
+	if strings.HasSuffix(str, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+		if err != nil {
+			return nil, err
+		}
+		if percent < 0 || percent > 100 {
+			return nil, errors.New(fmt.Sprintf("brightness must be between 0%% and 100%%, not %s", str))
+		}
+		brightness = uint8(math.Round(percent * 255 / 100))
+	} else {
+		parsed, err := strconv.ParseUint(str, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		brightness = uint8(parsed)
+	}
+
+	if brightness == 0 {
+		return &LightCommand{State: stringPtr("OFF")}, nil
+	}
+	return &LightCommand{State: stringPtr("ON"), Brightness: &brightness}, nil
+}
+
+func makeColorCommand(r uint8, g uint8, b uint8) *LightCommand {
+	// Simulate simple power control to be nice to Google Assistant
+	if r == g && g == b && r == 0 {
+		return &LightCommand{State: stringPtr("OFF")}
+	}
+
+	// Simulate simple white control
+	if r == g && g == b {
+		return &LightCommand{State: stringPtr("ON"), White: &r}
+	}
+
+	return &LightCommand{State: stringPtr("ON"), Color: &jsonColor{R: r, G: g, B: b}}
+}
+
+// Parses a 'mode,speed' string
+func ParseModeCommand(payload []byte) (*LightCommand, error) {
+	str := string(payload)
+	splitStr := strings.Split(str, ",")
+	if len(splitStr) != 2 {
+		return nil, errors.New(fmt.Sprintf("invalid number of separators: %d", len(splitStr)))
+	}
+
+	mode := splitStr[0]
+	speed, err := strconv.ParseUint(splitStr[1], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	speed8 := uint8(speed)
+	return &LightCommand{Effect: &mode, Speed: &speed8}, nil
+}
+
+// Parses 'on'/'off'
+func ParsePowerCommand(payload []byte) (*LightCommand, error) {
+	switch str := string(payload); str {
+	case "on":
+		return &LightCommand{State: stringPtr("ON")}, nil
+	case "off":
+		return &LightCommand{State: stringPtr("OFF")}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid power control string '%s'", str))
+	}
+}
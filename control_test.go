@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Controller of a simulated bulb whose commands are queued but never written, what it shows is tracked by the fader
+func newTestController(t *testing.T) *lightController {
+	t.Helper()
+	deviceConfig := &DeviceConfig{}
+	light := NewBleLight(NewSimulatedBulb(), nil, nil, 0, nil, nil,
+		deviceLogger(bleLog, "00:00:00:00:00:00", "test"))
+	poller := newStatusPoller(light, deviceConfig, nil, nil, nil)
+	states, err := newStateStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newLightController(light, poller, newFader(light, poller, deviceConfig),
+		getColorTempSettings(deviceConfig), "00:00:00:00:00:00", states, nil)
+}
+
+func applyJSON(t *testing.T, controller *lightController, payload string) {
+	t.Helper()
+	command, err := ParseJSONCommand([]byte(payload))
+	if err != nil {
+		t.Fatalf("%s: %v", payload, err)
+	}
+	if err := controller.Apply(command); err != nil {
+		t.Fatalf("%s: Apply() failed: %v", payload, err)
+	}
+}
+
+func expectShown(t *testing.T, controller *lightController, want lightColor) {
+	t.Helper()
+	if shown, _ := controller.fader.Shown(); shown == nil || *shown != want {
+		t.Fatalf("shown = %+v, want %+v", shown, want)
+	}
+}
+
+func TestBrightnessKeepsHue(t *testing.T) {
+	controller := newTestController(t)
+
+	applyJSON(t, controller, `{"state": "ON", "color": {"r": 255, "g": 128, "b": 0}}`)
+	applyJSON(t, controller, `{"brightness": 3}`)
+	expectShown(t, controller, lightColor{r: 3, g: 2, b: 0})
+	applyJSON(t, controller, `{"brightness": 1}`)
+	expectShown(t, controller, lightColor{r: 1, g: 1, b: 0})
+	applyJSON(t, controller, `{"brightness": 255}`)
+	expectShown(t, controller, lightColor{r: 255, g: 128, b: 0})
+
+	// Dimmed colors keep the hue too
+	applyJSON(t, controller, `{"color": {"r": 4, "g": 2, "b": 0}}`)
+	applyJSON(t, controller, `{"brightness": 255}`)
+	expectShown(t, controller, lightColor{r: 255, g: 128, b: 0})
+
+	// Until the light shows something else
+	controller.StatusReceived(&LightStatus{Power: true, Mode: "control", R: 0, G: 0, B: 200})
+	applyJSON(t, controller, `{"brightness": 100}`)
+	expectShown(t, controller, lightColor{r: 0, g: 0, b: 100})
+
+	applyJSON(t, controller, `{"white": 100}`)
+	applyJSON(t, controller, `{"color": {"r": 30, "g": 20, "b": 10}}`)
+	applyJSON(t, controller, `{"brightness": 255}`)
+	expectShown(t, controller, lightColor{r: 255, g: 170, b: 85})
+}
+
+func TestFailedCommandsAreNotRecorded(t *testing.T) {
+	controller := newTestController(t)
+	controller.reconciler = newReconciler(controller.addr, &DeviceConfig{}, "test", nil,
+		deviceLogger(bleLog, controller.addr, "test"), nil, nil)
+
+	applyJSON(t, controller, `{"state": "ON", "color": {"r": 255, "g": 128, "b": 0}}`)
+
+	// Writes fail once the writer is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = controller.light.RunWriter(ctx)
+	command, err := ParseJSONCommand([]byte(`{"color": {"r": 0, "g": 0, "b": 255}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.Apply(command); err != ErrWriterStopped {
+		t.Fatalf("Apply() = %v, want %v", err, ErrWriterStopped)
+	}
+
+	want := jsonColor{R: 255, G: 128, B: 0}
+	if state := controller.states.Commanded(controller.addr); state == nil || state.Color == nil || *state.Color != want {
+		t.Errorf("recorded state = %+v, want color %+v", state, want)
+	}
+	if desired := controller.reconciler.desired; desired == nil || desired.Color == nil || *desired.Color != want {
+		t.Errorf("desired state = %+v, want color %+v", desired, want)
+	}
+}
+
+func TestAdoptedChangesAreNotRecorded(t *testing.T) {
+	controller := newTestController(t)
+	controller.reconciler = newReconciler(controller.addr, &DeviceConfig{}, "test", nil,
+		deviceLogger(bleLog, controller.addr, "test"), nil, nil)
+
+	applyJSON(t, controller, `{"state": "ON", "color": {"r": 255, "g": 0, "b": 0}}`)
+	// Statuses right after a command aren't compared with it
+	controller.reconciler.sentAt = time.Now().Add(-reconcileSettleTime)
+	controller.reconciler.check(&LightStatus{Power: true, Mode: "control", R: 255, G: 0, B: 0})
+
+	// Changed by the app
+	_, event := controller.reconciler.check(&LightStatus{Power: true, Mode: "control", R: 0, G: 0, B: 255})
+	if event == nil || event.Action != "adopted" {
+		t.Fatalf("event = %+v, want the change adopted", event)
+	}
+	blue := jsonColor{R: 0, G: 0, B: 255}
+	if desired := controller.reconciler.desired; desired == nil || desired.Color == nil || *desired.Color != blue {
+		t.Errorf("desired state = %+v, want color %+v", desired, blue)
+	}
+
+	// Restored to what the bridge was told
+	red := jsonColor{R: 255, G: 0, B: 0}
+	if state := controller.states.Commanded(controller.addr); state == nil || state.Color == nil || *state.Color != red {
+		t.Errorf("recorded state = %+v, want color %+v", state, red)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/godbus/dbus"
+	"github.com/muka/go-bluetooth/bluez"
+)
+
+// Subscription to the PropertiesChanged signal of a single D-Bus object.
+//
+// go-bluetooth's WatchProperties can't be torn down: the goroutine it spawns never stops reading from the D-Bus signal
+// channel and UnwatchProperties blocks sending to a channel nobody reads anymore. Since godbus delivers signals to all
+// the registered channels while holding a lock, a single stuck subscriber stalls every other one, which is what used
+// to make the whole bridge hang when a light disconnected.
+//
+// propertyWatch keeps reading the signal channel until it has been unregistered from the connection, so Close() always
+// returns.
+type propertyWatch struct {
+	client     *bluez.Client
+	path       dbus.ObjectPath
+	signalChan chan *dbus.Signal
+	changeChan chan *bluez.PropertyChanged
+	stopChan   chan interface{}
+	doneChan   chan interface{}
+}
+
+func watchProperties(client *bluez.Client, path dbus.ObjectPath) (*propertyWatch, error) {
+	signalChan, err := client.Register(path, bluez.PropertiesInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	watch := &propertyWatch{
+		client:     client,
+		path:       path,
+		signalChan: signalChan,
+		changeChan: make(chan *bluez.PropertyChanged),
+		stopChan:   make(chan interface{}),
+		doneChan:   make(chan interface{}),
+	}
+	go watch.run()
+	return watch, nil
+}
+
+// Changes returns the channel property changes are sent to. It is closed when the watch is closed.
+func (watch *propertyWatch) Changes() <-chan *bluez.PropertyChanged {
+	return watch.changeChan
+}
+
+// Close stops the watch and unregisters it from the D-Bus connection. It must be called only once.
+func (watch *propertyWatch) Close() {
+	close(watch.stopChan)
+	<-watch.doneChan
+}
+
+func (watch *propertyWatch) run() {
+	defer close(watch.doneChan)
+	defer close(watch.changeChan)
+
+	for {
+		select {
+		case sig, ok := <-watch.signalChan:
+			if !ok {
+				// D-Bus connection closed
+				<-watch.stopChan
+				return
+			}
+			if !watch.dispatch(sig) {
+				watch.unregister()
+				return
+			}
+		case <-watch.stopChan:
+			watch.unregister()
+			return
+		}
+	}
+}
+
+// Forwards the changes carried by a signal, returns false if the watch was closed in the meantime.
+func (watch *propertyWatch) dispatch(sig *dbus.Signal) bool {
+	if sig == nil || sig.Name != bluez.PropertiesChanged || sig.Path != watch.path || len(sig.Body) < 2 {
+		return true
+	}
+	iface, ok := sig.Body[0].(string)
+	if !ok {
+		return true
+	}
+	changes, ok := sig.Body[1].(map[string]dbus.Variant)
+	if !ok {
+		return true
+	}
+
+	for name, value := range changes {
+		select {
+		case watch.changeChan <- &bluez.PropertyChanged{Interface: iface, Name: name, Value: value.Value()}:
+		case <-watch.stopChan:
+			return false
+		}
+	}
+	return true
+}
+
+func (watch *propertyWatch) unregister() {
+	// Keep draining while unregistering, godbus won't let go of the channel until all pending deliveries went through
+	unregistered := make(chan interface{})
+	go func() {
+		for {
+			select {
+			case <-watch.signalChan:
+			case <-unregistered:
+				return
+			}
+		}
+	}()
+
+	if err := watch.client.Unregister(watch.path, bluez.PropertiesInterface, watch.signalChan); err != nil {
+		bleLog.Errorf("unable to stop watching properties of '%s': %v", watch.path, err)
+	}
+	close(unregistered)
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Device management requests waiting to be handled, more than this are rejected
+const maxPendingDeviceRequests = 16
+
+// Payload of the bridge/request/device/* topics
+type deviceRequest struct {
+	Address    string  `json:"address"`
+	Mountpoint *string `json:"mountpoint,omitempty"`
+	// Sent back as is in the response, so requests and responses can be matched
+	Transaction interface{} `json:"transaction,omitempty"`
+}
+
+// Payload of the bridge/response/device/* topics
+type deviceResponse struct {
+	Status      string      `json:"status"`
+	Error       string      `json:"error,omitempty"`
+	Address     string      `json:"address,omitempty"`
+	Mountpoint  string      `json:"mountpoint,omitempty"`
+	Transaction interface{} `json:"transaction,omitempty"`
+}
+
+type pendingDeviceRequest struct {
+	action  string
+	payload []byte
+}
+
+// Returns the config of the device and the full mountpoint it's served at, as they are when it's called
+type deviceSettingsFunc func() (deviceConfig DeviceConfig, devMountpoint string)
+
+// Keeps the running devices in line with the configuration: adds, removes and renames devices while the bridge is
+// running, as requested over MQTT, saving the changes to the config file, and applies the changes made to the config
+// file when it's reloaded.
+//
+// Requests and reloads are handled one at a time, in the order they arrive. The config file is written first, so if
+// that fails nothing changes.
+type deviceManager struct {
+	configPath    string
+	client        *bridgeClient
+	states        *stateStore
+	devices       *Supervisor
+	newDeviceSpec func(addr string, settings deviceSettingsFunc, characteristics *characteristicsCache) ChildSpec
+	// Probing the characteristics takes a while, devices are only probed again if what was found is gone, even if
+	// they're renamed or removed and added back
+	characteristics *characteristicsCache
+	requestChan     chan pendingDeviceRequest
+	reloadChan      chan chan<- error
+	// Only changed by the goroutine running the manager, others must hold the lock to read them
+	lock       *sync.Mutex
+	config     Config
+	mountpoint string
+	// Closed when Run returns, nil while it's not running. Only changed while holding the lock.
+	stoppedChan chan interface{}
+	// Only touched by the goroutine running the manager
+	subscribedTopics []string
+}
+
+var ErrManagerNotRunning = errors.New("device manager is not running")
+
+func newDeviceManager(
+	configPath string,
+	config Config,
+	client *bridgeClient,
+	states *stateStore,
+	devices *Supervisor,
+	newDeviceSpec func(addr string, settings deviceSettingsFunc, characteristics *characteristicsCache) ChildSpec,
+) (*deviceManager, error) {
+	manager := &deviceManager{
+		configPath:      configPath,
+		client:          client,
+		states:          states,
+		devices:         devices,
+		newDeviceSpec:   newDeviceSpec,
+		characteristics: newCharacteristicsCache(),
+		requestChan:     make(chan pendingDeviceRequest, maxPendingDeviceRequests),
+		reloadChan:      make(chan chan<- error),
+		lock:            &sync.Mutex{},
+		config:          copyConfig(&config),
+		mountpoint:      getMountpoint(&config.MQTT),
+	}
+	for addr := range manager.config.Devices {
+		if err := manager.startDevice(addr); err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to add device '%s': %v", addr, err))
+		}
+	}
+	return manager, nil
+}
+
+// Copy of the config whose devices can be changed without affecting the original
+func copyConfig(config *Config) Config {
+	configCopy := *config
+	configCopy.Devices = make(map[string]DeviceConfig, len(config.Devices))
+	for addr, deviceConfig := range config.Devices {
+		configCopy.Devices[addr] = deviceConfig
+	}
+	return configCopy
+}
+
+func deviceChildName(addr string) string {
+	return fmt.Sprintf("device '%s'", addr)
+}
+
+func (manager *deviceManager) setConfig(config Config, mountpoint string) {
+	manager.lock.Lock()
+	manager.config = config
+	manager.mountpoint = mountpoint
+	manager.lock.Unlock()
+}
+
+func (manager *deviceManager) deviceSettings(addr string) (DeviceConfig, string) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	deviceConfig := manager.config.Devices[addr]
+	return deviceConfig, path.Join(manager.mountpoint, deviceConfig.MountPoint)
+}
+
+// Whether the Home Assistant discovery object ID belongs to a device that is currently configured
+func (manager *deviceManager) IsConfigured(objectID string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	for addr := range manager.config.Devices {
+		if getDiscoveryObjectID(addr) == objectID {
+			return true
+		}
+	}
+	return false
+}
+
+// Only called by the goroutine running the manager
+func (manager *deviceManager) discoveryPrefix() *string {
+	if manager.config.HomeAssistant != nil && manager.config.HomeAssistant.Discovery {
+		return stringPtr(getDiscoveryPrefix(&manager.config))
+	}
+	return nil
+}
+
+func (manager *deviceManager) requestTopic(action string) string {
+	return path.Join(manager.mountpoint, "bridge/request/device", action)
+}
+
+func (manager *deviceManager) responseTopic(action string) string {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return path.Join(manager.mountpoint, "bridge/response/device", action)
+}
+
+// Subscribes to the request topics and, with Home Assistant discovery enabled, to the discovery configs to clean
+// up the stale ones
+func (manager *deviceManager) subscribe() {
+	for _, action := range []string{"add", "remove", "rename"} {
+		action := action
+		topic := manager.requestTopic(action)
+		manager.subscribedTopics = append(manager.subscribedTopics, topic)
+		manager.client.Subscribe(topic, 2, func(_ mqtt.Client, message mqtt.Message) {
+			select {
+			case manager.requestChan <- pendingDeviceRequest{action: action, payload: message.Payload()}:
+			default:
+				manager.respond(action, nil, errors.New("too many pending requests"))
+			}
+		})
+	}
+
+	if prefix := manager.discoveryPrefix(); prefix != nil {
+		// Devices can be added and removed at runtime, so this has to ask the manager
+		topicFilter := RemoveStaleDiscovery(manager.client, *prefix, manager.mountpoint, manager.IsConfigured)
+		manager.subscribedTopics = append(manager.subscribedTopics, topicFilter)
+	}
+}
+
+func (manager *deviceManager) unsubscribe() {
+	if len(manager.subscribedTopics) > 0 {
+		manager.client.Unsubscribe(manager.subscribedTopics...)
+		manager.subscribedTopics = nil
+	}
+}
+
+// Handles requests and reloads until ctx is cancelled
+func (manager *deviceManager) Run(ctx context.Context) error {
+	stoppedChan := make(chan interface{})
+	manager.lock.Lock()
+	manager.stoppedChan = stoppedChan
+	manager.lock.Unlock()
+	defer func() {
+		manager.lock.Lock()
+		manager.stoppedChan = nil
+		manager.lock.Unlock()
+		close(stoppedChan)
+	}()
+
+	for addr := range manager.config.Devices {
+		manager.publishDiscovery(addr)
+	}
+	manager.subscribe()
+	defer manager.unsubscribe()
+
+	for {
+		select {
+		case request := <-manager.requestChan:
+			manager.handle(request)
+		case result := <-manager.reloadChan:
+			result <- manager.reload()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Re-reads the config file and applies the changes, waiting for the manager to be done with them. Fails with
+// ErrManagerNotRunning if the manager isn't running, or stops before getting to it.
+func (manager *deviceManager) Reload() error {
+	manager.lock.Lock()
+	stoppedChan := manager.stoppedChan
+	manager.lock.Unlock()
+	if stoppedChan == nil {
+		log.Warning("not reloading config: ", ErrManagerNotRunning)
+		return ErrManagerNotRunning
+	}
+
+	log.Info("reloading config")
+	result := make(chan error, 1)
+	select {
+	case manager.reloadChan <- result:
+	case <-stoppedChan:
+		log.Warning("not reloading config: ", ErrManagerNotRunning)
+		return ErrManagerNotRunning
+	}
+	// The manager always answers a reload it took
+	if err := <-result; err != nil {
+		log.Error("unable to reload config, keeping the old one: ", err)
+		return err
+	}
+	log.Info("config reloaded")
+	return nil
+}
+
+func (manager *deviceManager) handle(pending pendingDeviceRequest) {
+	var request deviceRequest
+	if err := json.Unmarshal(pending.payload, &request); err != nil {
+		manager.respond(pending.action, nil, errors.New(fmt.Sprintf("invalid request: %v", err)))
+		return
+	}
+
+	var err error
+	switch pending.action {
+	case "add":
+		err = manager.add(&request)
+	case "remove":
+		err = manager.remove(&request)
+	case "rename":
+		err = manager.rename(&request)
+	}
+	if err != nil {
+		withFields(log, "address", request.Address).Errorf("unable to %s device: %v", pending.action, err)
+	} else {
+		withFields(log, "address", request.Address).Infof("%s done", pending.action)
+	}
+	manager.respond(pending.action, &request, err)
+}
+
+func (manager *deviceManager) respond(action string, request *deviceRequest, err error) {
+	response := deviceResponse{Status: "ok"}
+	if err != nil {
+		response.Status = "error"
+		response.Error = err.Error()
+	}
+	if request != nil {
+		response.Address = request.Address
+		response.Transaction = request.Transaction
+		if request.Mountpoint != nil {
+			response.Mountpoint = *request.Mountpoint
+		}
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Error("unable to serialize device management response: ", err)
+		return
+	}
+	manager.client.Publish(manager.responseTopic(action), 1, false, payload)
+}
+
+// Returns the address as it's written in the config, if the device is configured
+func (manager *deviceManager) findDevice(addr string) (string, bool) {
+	for configured := range manager.config.Devices {
+		if strings.EqualFold(configured, addr) {
+			return configured, true
+		}
+	}
+	return "", false
+}
+
+// Writes the devices to the config file, after edit has changed them in it
+func (manager *deviceManager) saveConfig(devices map[string]DeviceConfig, edit func(*configFile) error) error {
+	file, err := readConfigFile(manager.configPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to read config file: %v", err))
+	}
+	if err := edit(file); err != nil {
+		return err
+	}
+	if err := file.Save(devices); err != nil {
+		return errors.New(fmt.Sprintf("unable to save config file: %v", err))
+	}
+	return nil
+}
+
+func (manager *deviceManager) startDevice(addr string) error {
+	settings := func() (DeviceConfig, string) {
+		return manager.deviceSettings(addr)
+	}
+	return manager.devices.Add(manager.newDeviceSpec(addr, settings, manager.characteristics))
+}
+
+// Stops the device and clears its retained topics, so nothing is left behind under its mountpoint
+func (manager *deviceManager) stopDevice(addr string, devMountpoint string) error {
+	if err := manager.devices.Remove(deviceChildName(addr)); err != nil {
+		return err
+	}
+	ClearDeviceTopics(manager.client, devMountpoint)
+	return nil
+}
+
+func (manager *deviceManager) publishDiscovery(addr string) {
+	if prefix := manager.discoveryPrefix(); prefix != nil {
+		deviceConfig := manager.config.Devices[addr]
+		devMountpoint := path.Join(manager.mountpoint, deviceConfig.MountPoint)
+		PublishDiscovery(manager.client, *prefix, addr, &deviceConfig, manager.mountpoint, devMountpoint)
+	}
+}
+
+func (manager *deviceManager) removeDiscovery(addr string) {
+	if prefix := manager.discoveryPrefix(); prefix != nil {
+		RemoveDiscovery(manager.client, *prefix, addr)
+	}
+}
+
+func (manager *deviceManager) add(request *deviceRequest) error {
+	addr := strings.ToUpper(strings.TrimSpace(request.Address))
+	if err := validateDeviceAddress(addr); err != nil {
+		return err
+	}
+	request.Address = addr
+	if _, ok := manager.findDevice(addr); ok {
+		return errors.New("device already exists")
+	}
+	if request.Mountpoint == nil {
+		return errors.New("mountpoint is required")
+	}
+	if err := validateMountpoint(*request.Mountpoint, addr, manager.config.Devices); err != nil {
+		return err
+	}
+
+	deviceConfig := DeviceConfig{MountPoint: *request.Mountpoint}
+	config := copyConfig(&manager.config)
+	config.Devices[addr] = deviceConfig
+	err := manager.saveConfig(config.Devices, func(file *configFile) error {
+		return file.AddDevice(addr, deviceConfig)
+	})
+	if err != nil {
+		return err
+	}
+	manager.setConfig(config, manager.mountpoint)
+
+	if err := manager.startDevice(addr); err != nil {
+		return err
+	}
+	manager.publishDiscovery(addr)
+	return nil
+}
+
+func (manager *deviceManager) remove(request *deviceRequest) error {
+	addr, ok := manager.findDevice(strings.TrimSpace(request.Address))
+	if !ok {
+		return errors.New("device not found")
+	}
+	request.Address = addr
+	_, devMountpoint := manager.deviceSettings(addr)
+
+	config := copyConfig(&manager.config)
+	delete(config.Devices, addr)
+	err := manager.saveConfig(config.Devices, func(file *configFile) error {
+		return file.RemoveDevice(addr)
+	})
+	if err != nil {
+		return err
+	}
+	manager.setConfig(config, manager.mountpoint)
+
+	manager.removeDiscovery(addr)
+	bridgeMetrics.RemoveDevice(addr)
+	manager.states.Remove(addr)
+	return manager.stopDevice(addr, devMountpoint)
+}
+
+func (manager *deviceManager) rename(request *deviceRequest) error {
+	addr, ok := manager.findDevice(strings.TrimSpace(request.Address))
+	if !ok {
+		return errors.New("device not found")
+	}
+	request.Address = addr
+	if request.Mountpoint == nil {
+		return errors.New("mountpoint is required")
+	}
+	if err := validateMountpoint(*request.Mountpoint, addr, manager.config.Devices); err != nil {
+		return err
+	}
+
+	deviceConfig, oldDevMountpoint := manager.deviceSettings(addr)
+	if deviceConfig.MountPoint == *request.Mountpoint {
+		return nil
+	}
+	deviceConfig.MountPoint = *request.Mountpoint
+
+	config := copyConfig(&manager.config)
+	config.Devices[addr] = deviceConfig
+	err := manager.saveConfig(config.Devices, func(file *configFile) error {
+		return file.SetDeviceMountpoint(addr, deviceConfig.MountPoint)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := manager.stopDevice(addr, oldDevMountpoint); err != nil {
+		return err
+	}
+	manager.setConfig(config, manager.mountpoint)
+	if err := manager.startDevice(addr); err != nil {
+		return err
+	}
+	manager.publishDiscovery(addr)
+	return nil
+}
+
+// Whether the device has to be reconnected for the new config to take effect. Other settings are read every time
+// the device connects.
+func deviceNeedsRestart(oldConfig *DeviceConfig, newConfig *DeviceConfig) bool {
+	return oldConfig.MountPoint != newConfig.MountPoint ||
+		!equalStringPtr(oldConfig.RGBCharacteristic, newConfig.RGBCharacteristic) ||
+		!equalStringPtr(oldConfig.NotifyCharacteristic, newConfig.NotifyCharacteristic)
+}
+
+// Applies the changes made to the config file. Devices that were added are started, those that were removed are
+// stopped and those whose mountpoint or characteristics changed are restarted; the other ones keep running. If the
+// new config is not valid, or the bridge can't connect to the broker with the new MQTT settings, nothing changes.
+func (manager *deviceManager) reload() error {
+	config, err := ReadConfig(manager.configPath)
+	if err != nil {
+		return err
+	}
+	if err := ValidateConfig(&config); err != nil {
+		return err
+	}
+	oldConfig := manager.config
+	oldMountpoint := manager.mountpoint
+	oldPrefix := manager.discoveryPrefix()
+	mountpoint := getMountpoint(&config.MQTT)
+
+	if !reflect.DeepEqual(oldConfig.Bluetooth, config.Bluetooth) {
+		log.Warning("bluetooth settings changed, restart the bridge to apply them")
+		config.Bluetooth = oldConfig.Bluetooth
+	}
+	if !reflect.DeepEqual(oldConfig.HTTP, config.HTTP) {
+		log.Warning("HTTP settings changed, restart the bridge to apply them")
+		config.HTTP = oldConfig.HTTP
+	}
+	if !reflect.DeepEqual(oldConfig.Logging, config.Logging) {
+		log.Warning("logging settings changed, restart the bridge to apply them")
+		config.Logging = oldConfig.Logging
+	}
+	if !equalStringPtr(oldConfig.StateFile, config.StateFile) {
+		log.Warning("state file changed, restart the bridge to apply it")
+		config.StateFile = oldConfig.StateFile
+	}
+
+	if changed, err := manager.client.SettingsChanged(&config.MQTT); err != nil {
+		return err
+	} else if changed {
+		log.Info("MQTT settings changed, reconnecting to the broker")
+		if err := manager.client.Reconfigure(&config.MQTT); err != nil {
+			return errors.New(fmt.Sprintf("unable to connect to MQTT broker with the new settings: %v", err))
+		}
+	}
+
+	// Topics may be moving
+	manager.unsubscribe()
+
+	// Stop devices first, so their mountpoints are free when the other ones start
+	restarted := make(map[string]bool)
+	for addr, oldDeviceConfig := range oldConfig.Devices {
+		oldDevMountpoint := path.Join(oldMountpoint, oldDeviceConfig.MountPoint)
+		newDeviceConfig, ok := config.Devices[addr]
+		deviceLog := deviceLogger(log, addr, oldDevMountpoint)
+		switch {
+		case !ok:
+			deviceLog.Info("device was removed")
+			manager.removeDiscovery(addr)
+			bridgeMetrics.RemoveDevice(addr)
+			manager.states.Remove(addr)
+		case mountpoint != oldMountpoint || deviceNeedsRestart(&oldDeviceConfig, &newDeviceConfig):
+			deviceLog.Info("device changed, restarting it")
+			restarted[addr] = true
+		default:
+			if !reflect.DeepEqual(oldDeviceConfig, newDeviceConfig) {
+				deviceLog.Info("device settings changed, they'll be applied when it reconnects")
+			}
+			continue
+		}
+		if err := manager.stopDevice(addr, oldDevMountpoint); err != nil {
+			deviceLog.Errorf("unable to stop device: %v", err)
+		}
+	}
+
+	manager.setConfig(config, mountpoint)
+
+	prefix := manager.discoveryPrefix()
+	if oldPrefix != nil && !equalStringPtr(oldPrefix, prefix) {
+		// The configs under the old prefix won't be updated anymore
+		for addr := range config.Devices {
+			if _, ok := oldConfig.Devices[addr]; ok {
+				RemoveDiscovery(manager.client, *oldPrefix, addr)
+			}
+		}
+	}
+
+	for addr, deviceConfig := range config.Devices {
+		deviceLog := deviceLogger(log, addr, path.Join(mountpoint, deviceConfig.MountPoint))
+		if _, ok := oldConfig.Devices[addr]; !ok {
+			deviceLog.Info("device was added")
+		} else if !restarted[addr] {
+			manager.publishDiscovery(addr)
+			continue
+		}
+		if err := manager.startDevice(addr); err != nil {
+			deviceLog.Errorf("unable to start device: %v", err)
+		}
+		manager.publishDiscovery(addr)
+	}
+
+	manager.subscribe()
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadWithoutManager(t *testing.T) {
+	manager := &deviceManager{lock: &sync.Mutex{}, reloadChan: make(chan chan<- error)}
+	reload := func() <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- manager.Reload()
+		}()
+		return result
+	}
+	expectNotRunning := func(result <-chan error) {
+		t.Helper()
+		select {
+		case err := <-result:
+			if err != ErrManagerNotRunning {
+				t.Errorf("Reload() = %v, want %v", err, ErrManagerNotRunning)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Reload() blocked")
+		}
+	}
+
+	// Before Run starts
+	expectNotRunning(reload())
+
+	// Run returns while the reload is waiting for it
+	stoppedChan := make(chan interface{})
+	manager.stoppedChan = stoppedChan
+	result := reload()
+	time.Sleep(10 * time.Millisecond)
+	manager.lock.Lock()
+	manager.stoppedChan = nil
+	manager.lock.Unlock()
+	close(stoppedChan)
+	expectNotRunning(result)
+}
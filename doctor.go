@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/godbus/dbus"
+	"github.com/muka/go-bluetooth/bluez"
+	adapter1 "github.com/muka/go-bluetooth/bluez/profile/adapter"
+	device2 "github.com/muka/go-bluetooth/bluez/profile/device"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDoctorTimeout = 10 * time.Second
+
+// Oldest BlueZ release whose D-Bus API go-bluetooth works with
+var minBluezVersion = [2]int{5, 48}
+
+// Where distributions install bluetoothd, in case it can't be found through the running process
+var bluetoothdPaths = []string{
+	"/usr/lib/bluetooth/bluetoothd",
+	"/usr/libexec/bluetooth/bluetoothd",
+	"/usr/sbin/bluetoothd",
+}
+
+var bluezVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+const (
+	hintBluezPatch = "some lights need a patched BlueZ to resolve their services, see \"Notes on Bluez\" in the README"
+	hintPowerCycle = "remove power from the light for a few seconds; make sure it's in range and that no phone is " +
+		"connected to it"
+	hintIOError = "the adapter is stuck: reset it (see reset_prog and \"Notes on Raspberry Pi\" in the README), or " +
+		"reboot or unplug and replug it"
+)
+
+// Results of the doctor checks, printed as they come
+type doctorReport struct {
+	out      io.Writer
+	failures int
+	warnings int
+}
+
+func (report *doctorReport) print(status string, check string, detail string, hint string) {
+	line := fmt.Sprintf("[%s] %s", status, check)
+	if detail != "" {
+		line += ": " + detail
+	}
+	_, _ = fmt.Fprintln(report.out, line)
+	if hint != "" {
+		_, _ = fmt.Fprintf(report.out, "       hint: %s\n", hint)
+	}
+}
+
+func (report *doctorReport) Pass(check string, detail string) {
+	report.print("PASS", check, detail, "")
+}
+
+func (report *doctorReport) Warn(check string, detail string, hint string) {
+	report.warnings++
+	report.print("WARN", check, detail, hint)
+}
+
+func (report *doctorReport) Fail(check string, detail string, hint string) {
+	report.failures++
+	report.print("FAIL", check, detail, hint)
+}
+
+func (report *doctorReport) Skip(check string, reason string) {
+	report.print("SKIP", check, reason, "")
+}
+
+func isAccessDenied(err error) bool {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) {
+		return dbusErr.Name == "org.freedesktop.DBus.Error.AccessDenied"
+	}
+	return err != nil && strings.Contains(err.Error(), "AccessDenied")
+}
+
+// Asks D-Bus which process owns the BlueZ name, then asks its executable for its version. Returns the PID of
+// bluetoothd, 0 if it's not running, and its version as it prints it.
+func getBluezVersion() (pid uint32, version string, err error) {
+	conn, err := bluez.GetConnection(bluez.SystemBus)
+	if err != nil {
+		return 0, "", errors.New(fmt.Sprintf("unable to connect to the system bus: %v", err))
+	}
+	call := conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, bluez.OrgBluezInterface)
+	if err := call.Store(&pid); err != nil {
+		return 0, "", errors.New(fmt.Sprintf("BlueZ is not running: %v", err))
+	}
+
+	// The executable of a process owned by root can't be looked at by everyone
+	candidates := append([]string{fmt.Sprintf("/proc/%d/exe", pid)}, bluetoothdPaths...)
+	for _, candidate := range candidates {
+		if output, err := exec.Command(candidate, "--version").Output(); err == nil {
+			return pid, strings.TrimSpace(string(output)), nil
+		}
+	}
+	return pid, "", errors.New(fmt.Sprintf("unable to run bluetoothd (PID %d) to get its version", pid))
+}
+
+func checkBluez(report *doctorReport) bool {
+	if _, err := bluez.GetConnection(bluez.SystemBus); err != nil {
+		report.Fail("D-Bus", err.Error(),
+			"make sure the system bus is running; in a container, mount the host's /var/run/dbus")
+		return false
+	}
+	report.Pass("D-Bus", "connected to the system bus")
+
+	pid, version, err := getBluezVersion()
+	if err != nil {
+		if pid != 0 {
+			report.Warn("BlueZ version", err.Error(), "run the doctor as root to check the version")
+			return true
+		}
+		report.Fail("BlueZ", err.Error(), "start BlueZ, e.g. with `systemctl start bluetooth`")
+		return false
+	}
+
+	match := bluezVersionRegexp.FindStringSubmatch(version)
+	if match == nil {
+		report.Warn("BlueZ version", fmt.Sprintf("unable to parse version '%s'", version), "")
+		return true
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	if major < minBluezVersion[0] || (major == minBluezVersion[0] && minor < minBluezVersion[1]) {
+		report.Fail("BlueZ version", version,
+			fmt.Sprintf("BlueZ %d.%d or newer is required", minBluezVersion[0], minBluezVersion[1]))
+		return true
+	}
+	report.Pass("BlueZ version", version)
+	return true
+}
+
+// Everything the bridge does goes through the object manager, if it can't be used nothing else will work
+func checkDBusPermissions(report *doctorReport) bool {
+	objectManager, err := bluez.GetObjectManager()
+	if err == nil {
+		_, err = objectManager.GetManagedObjects()
+	}
+	switch {
+	case isAccessDenied(err):
+		report.Fail("D-Bus permissions", err.Error(),
+			"run the bridge as root or as a user in the group the BlueZ D-Bus policy allows, usually `bluetooth`")
+		return false
+	case err != nil:
+		report.Fail("D-Bus permissions", err.Error(), "")
+		return false
+	}
+	report.Pass("D-Bus permissions", "BlueZ objects can be listed")
+	return true
+}
+
+func checkAdapter(report *doctorReport, config *Config) *adapter1.Adapter1 {
+	adapter, err := getAdapter(config)
+	if err != nil {
+		report.Fail("Bluetooth adapter", err.Error(),
+			"check that the adapter is plugged in and shows up in `bluetoothctl list`")
+		return nil
+	}
+	name, _ := adapter.GetAdapterID()
+	address, _ := adapter.GetAddress()
+	report.Pass("Bluetooth adapter", fmt.Sprintf("%s (%s)", name, address))
+
+	if powered, _ := adapter.GetPowered(); powered {
+		report.Pass("adapter power", "on")
+		return adapter
+	}
+	// The bridge does the same when it starts
+	if err := adapter.SetPowered(true); err != nil {
+		report.Fail("adapter power", fmt.Sprintf("off, unable to turn it on: %v", err),
+			"check whether it's blocked with `rfkill list bluetooth`")
+		adapter.Close()
+		return nil
+	}
+	report.Warn("adapter power", "was off, turned it on", "")
+	return adapter
+}
+
+// Looks for the given devices for up to timeout, so the ones BlueZ doesn't know about can be connected to
+func discoverDevices(adapter *adapter1.Adapter1, addrs []string, timeout time.Duration) {
+	missing := make(map[string]bool)
+	for _, addr := range addrs {
+		if _, err := adapter.GetDeviceByAddress(addr); err != nil {
+			missing[strings.ToUpper(addr)] = true
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	scanChan, cancel, err := adapter.OnDeviceDiscovered()
+	if err != nil {
+		log.Error("unable to retrieve discovered devices channel: ", err)
+		return
+	}
+	if err := adapter.StartDiscovery(); err != nil {
+		log.Warning("failed to start discovery: ", err)
+	}
+	log.Infof("looking for %d devices for up to %v...", len(missing), timeout)
+
+	deadline := time.After(timeout)
+DiscoveryLoop:
+	for len(missing) > 0 {
+		select {
+		case discovered := <-scanChan:
+			if discovered.Type != adapter1.DeviceAdded {
+				continue
+			}
+			if device, err := device2.NewDevice1(discovered.Path); err == nil {
+				addr, _ := device.GetAddress()
+				delete(missing, strings.ToUpper(addr))
+				device.Close()
+			}
+		case <-deadline:
+			break DiscoveryLoop
+		}
+	}
+	cancel()
+	_ = adapter.StopDiscovery()
+}
+
+func checkDevice(report *doctorReport, adapter *adapter1.Adapter1, addr string, deviceConfig *DeviceConfig) {
+	check := func(name string) string {
+		return fmt.Sprintf("device '%s' %s", addr, name)
+	}
+
+	device, err := adapter.GetDeviceByAddress(addr)
+	if err != nil {
+		report.Fail(check("reachable"), "not found during discovery", hintPowerCycle)
+		return
+	}
+
+	if connected, _ := device.GetConnected(); connected {
+		// Probably the bridge is using it, leave it connected
+		report.Pass(check("reachable"), "connected already")
+		defer device.Close()
+	} else {
+		if err := device.Connect(); err != nil {
+			device.Close()
+			if isIOError(err) {
+				report.Fail(check("reachable"), err.Error(), hintIOError)
+			} else {
+				report.Fail(check("reachable"), err.Error(), hintPowerCycle)
+			}
+			return
+		}
+		report.Pass(check("reachable"), "connected")
+		defer disconnectDevice(device)
+	}
+
+	if resolved, err := waitServicesResolved(context.Background(), device, addr); !resolved {
+		report.Fail(check("services"), err.Error(), hintBluezPatch)
+		return
+	}
+	report.Pass(check("services"), "resolved")
+
+	// Same as what the bridge does when it connects
+	writeChar, notifyChar, err := resolveCharacteristics(device, addr, deviceConfig, newCharacteristicsCache())
+	if err != nil {
+		report.Fail(check("characteristics"), err.Error(), hintBluezPatch+"; otherwise set rgb_characteristic and "+
+			"notify_characteristic to ones of those logged above")
+		return
+	}
+	defer writeChar.Close()
+	defer notifyChar.Close()
+	report.Pass(check("characteristics"),
+		fmt.Sprintf("write %s, notify %s", writeChar.Properties.UUID, notifyChar.Properties.UUID))
+}
+
+// Checks the BlueZ and adapter setup and, if a config file is given, that the configured devices can be used.
+// Returns the exit code: 0 if everything passed, 1 otherwise.
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	timeout := flags.Duration("timeout", defaultDoctorTimeout, "how long to look for devices BlueZ doesn't know about")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s doctor [--timeout duration] [config]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	report := &doctorReport{out: os.Stdout}
+	defer func() {
+		_, _ = fmt.Fprintf(report.out, "\n%d failed, %d warnings\n", report.failures, report.warnings)
+	}()
+
+	var config Config
+	if flags.NArg() == 1 {
+		var err error
+		// Carry on anyway, the Bluetooth setup can still be checked
+		if config, err = ReadConfig(flags.Arg(0)); err != nil {
+			report.Fail("config", err.Error(), "")
+		} else if err = ValidateConfig(&config); err != nil {
+			report.Fail("config", err.Error(), "")
+		} else {
+			report.Pass("config", fmt.Sprintf("%d devices", len(config.Devices)))
+		}
+	}
+
+	addrs := make([]string, 0, len(config.Devices))
+	for addr := range config.Devices {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var adapter *adapter1.Adapter1
+	if checkBluez(report) && checkDBusPermissions(report) {
+		adapter = checkAdapter(report, &config)
+	}
+	if adapter == nil {
+		for _, addr := range addrs {
+			report.Skip(fmt.Sprintf("device '%s'", addr), "no usable adapter")
+		}
+		return 1
+	}
+	defer adapter.Close()
+
+	discoverDevices(adapter, addrs, *timeout)
+	for _, addr := range addrs {
+		deviceConfig := config.Devices[addr]
+		checkDevice(report, adapter, addr, &deviceConfig)
+	}
+
+	if report.failures > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Fastest rate the frames of a transition are sent at. The writer sends them slower if min_write_interval says so,
+	// dropping the ones it can't keep up with.
+	transitionFrameInterval = 50 * time.Millisecond
+	// Longest transition accepted
+	maxTransition = time.Hour
+)
+
+// Color shown by a light, either by the RGB LEDs or by the warm white ones
+type lightColor struct {
+	white bool
+	r     uint8
+	g     uint8
+	b     uint8
+	// Intensity of the warm white LEDs
+	w uint8
+}
+
+// Black, shown by the same LEDs
+func (color lightColor) black() lightColor {
+	return lightColor{white: color.white}
+}
+
+// Returns the color a light in the given status shows, nil if it's running a built-in mode
+func statusColor(status *LightStatus) *lightColor {
+	switch {
+	case status.Mode != "control":
+		return nil
+	case status.WarmWhite:
+		return &lightColor{white: true, w: status.WarmWhiteIntensity}
+	}
+	return &lightColor{r: status.R, g: status.G, b: status.B}
+}
+
+// Whether the colors are the same, give or take what the light rounds them to
+func (color lightColor) near(other lightColor) bool {
+	return color.white == other.white && channelMatches(color.w, other.w) &&
+		channelMatches(color.r, other.r) && channelMatches(color.g, other.g) && channelMatches(color.b, other.b)
+}
+
+func (color lightColor) send(light BleLight) error {
+	if color.white {
+		return light.SetWarmWhite(color.w)
+	}
+	return light.SetRGB(color.r, color.g, color.b)
+}
+
+// A fade from one color to another, shown by the same LEDs
+type transition struct {
+	from     lightColor
+	to       lightColor
+	duration time.Duration
+	// Turn the light off at the end, then set it back to this color so it comes back on with it
+	powerOff bool
+	restore  lightColor
+}
+
+// What the fader sends frames for: either a transition, or a colorMix that goes on until something replaces it
+type fade struct {
+	transition *transition
+	mix        *colorMix
+	// Only the frames of the latest fade are sent
+	generation uint64
+}
+
+// Converts an sRGB channel to linear light
+func srgbToLinear(value uint8) float64 {
+	c := float64(value) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(c float64) uint8 {
+	if c <= 0.0031308 {
+		c *= 12.92
+	} else {
+		c = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(math.Max(0, math.Min(1, c)) * 255))
+}
+
+// Converts an sRGB color to Oklab, where colors that are the same distance apart look about as different
+func rgbToOklab(r uint8, g uint8, b uint8) (l float64, a float64, bb float64) {
+	lr, lg, lb := srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	lms1 := math.Cbrt(0.4122214708*lr + 0.5363325363*lg + 0.0514459929*lb)
+	lms2 := math.Cbrt(0.2119034982*lr + 0.6806995451*lg + 0.1073969566*lb)
+	lms3 := math.Cbrt(0.0883024619*lr + 0.2817188376*lg + 0.6299787005*lb)
+	return 0.2104542553*lms1 + 0.7936177850*lms2 - 0.0040720468*lms3,
+		1.9779984951*lms1 - 2.4285922050*lms2 + 0.4505937099*lms3,
+		0.0259040371*lms1 + 0.7827717662*lms2 - 0.8086757660*lms3
+}
+
+func oklabToRgb(l float64, a float64, bb float64) (r uint8, g uint8, b uint8) {
+	lms1 := math.Pow(l+0.3963377774*a+0.2158037573*bb, 3)
+	lms2 := math.Pow(l-0.1055613458*a-0.0638541728*bb, 3)
+	lms3 := math.Pow(l-0.0894841775*a-1.2914855480*bb, 3)
+	return linearToSrgb(4.0767416621*lms1 - 3.3077115913*lms2 + 0.2309699292*lms3),
+		linearToSrgb(-1.2684380046*lms1 + 2.6097574011*lms2 - 0.3413193965*lms3),
+		linearToSrgb(-0.0041960863*lms1 - 0.7034186147*lms2 + 1.7076147010*lms3)
+}
+
+func lerp(from float64, to float64, progress float64) float64 {
+	return from + (to-from)*progress
+}
+
+// Returns the color at the given progress, between 0 and 1, of a fade between two colors shown by the same LEDs
+func fadeColors(from lightColor, to lightColor, progress float64) lightColor {
+	if to.white {
+		// Oklab lightness of a gray
+		fromL, toL := math.Cbrt(srgbToLinear(from.w)), math.Cbrt(srgbToLinear(to.w))
+		return lightColor{white: true, w: linearToSrgb(math.Pow(lerp(fromL, toL, progress), 3))}
+	}
+	fromL, fromA, fromB := rgbToOklab(from.r, from.g, from.b)
+	toL, toA, toB := rgbToOklab(to.r, to.g, to.b)
+	r, g, b := oklabToRgb(lerp(fromL, toL, progress), lerp(fromA, toA, progress), lerp(fromB, toB, progress))
+	return lightColor{r: r, g: g, b: b}
+}
+
+// Sends the frames of software transitions and color mixes to a light, and keeps track of what the light shows so
+// transitions know where to start from.
+//
+// Frames are queued to the writer like any other command. Starting a fade or cancelling it makes sure no frame of the
+// previous one is queued afterwards, so a new command is never overridden by a stale frame.
+type fader struct {
+	light         BleLight
+	poller        *statusPoller
+	frameInterval time.Duration
+	fadeChan      chan *fade
+
+	lock       *sync.Mutex
+	generation uint64
+	running    bool
+	// What the light shows, nil if it's not known or a built-in mode is running
+	shown *lightColor
+	on    bool
+	// Color temperature, in mireds, the light was set to, nil if it was set to something else
+	colorTemp *uint16
+}
+
+func newFader(light BleLight, poller *statusPoller, deviceConfig *DeviceConfig) *fader {
+	frameInterval := transitionFrameInterval
+	if minWriteInterval := getMinWriteInterval(deviceConfig); minWriteInterval > frameInterval {
+		frameInterval = minWriteInterval
+	}
+	return &fader{
+		light:         light,
+		poller:        poller,
+		frameInterval: frameInterval,
+		fadeChan:      make(chan *fade, 1),
+		lock:          &sync.Mutex{},
+	}
+}
+
+// Returns what the light shows, nil if it's not known, and whether it's on
+func (fader *fader) Shown() (*lightColor, bool) {
+	fader.lock.Lock()
+	defer fader.lock.Unlock()
+	if fader.shown == nil {
+		return nil, fader.on
+	}
+	shown := *fader.shown
+	return &shown, fader.on
+}
+
+// Records a color or power state that was just sent to the light
+func (fader *fader) Sent(shown *lightColor, on bool) {
+	fader.lock.Lock()
+	fader.shown = shown
+	fader.on = on
+	fader.lock.Unlock()
+}
+
+// Returns the color temperature, in mireds, the light was set to, nil if it was set to something else
+func (fader *fader) ColorTemp() *uint16 {
+	fader.lock.Lock()
+	defer fader.lock.Unlock()
+	if fader.colorTemp == nil {
+		return nil
+	}
+	colorTemp := *fader.colorTemp
+	return &colorTemp
+}
+
+// Records the color temperature the light was just set to, nil if it was set to something else
+func (fader *fader) SetColorTemp(colorTemp *uint16) {
+	fader.lock.Lock()
+	fader.colorTemp = colorTemp
+	fader.lock.Unlock()
+}
+
+// Records what the light reported, unless a fade is running
+func (fader *fader) StatusReceived(status *LightStatus) {
+	fader.lock.Lock()
+	defer fader.lock.Unlock()
+	if fader.running {
+		return
+	}
+	fader.on = status.Power
+	shown := statusColor(status)
+	// Something else changed the color
+	if shown == nil || fader.shown == nil || !shown.near(*fader.shown) {
+		fader.colorTemp = nil
+	}
+	fader.shown = shown
+}
+
+// Stops the running fade, if any. No frame of it is sent after this returns.
+func (fader *fader) Cancel() {
+	fader.lock.Lock()
+	fader.generation++
+	fader.running = false
+	fader.lock.Unlock()
+}
+
+// Starts a transition, replacing the running fade
+func (fader *fader) Start(transition *transition) {
+	fader.start(&fade{transition: transition})
+}
+
+// Starts alternating between the colors of the mix, replacing the running fade
+func (fader *fader) StartMix(mix *colorMix) {
+	fader.start(&fade{mix: mix})
+}
+
+func (fader *fader) start(fade *fade) {
+	fader.lock.Lock()
+	fader.generation++
+	fade.generation = fader.generation
+	fader.running = true
+	fader.lock.Unlock()
+
+	select {
+	case <-fader.fadeChan:
+	default:
+	}
+	fader.fadeChan <- fade
+}
+
+// Sends the frame of the fade that is due, returns false once the fade is over or was cancelled
+func (fader *fader) step(fade *fade, startedAt time.Time, index int) bool {
+	fader.lock.Lock()
+	defer fader.lock.Unlock()
+	if fade.generation != fader.generation {
+		return false
+	}
+
+	if fade.mix != nil {
+		frame := fade.mix.frame(index)
+		// Each frame is only sent when it changes
+		if fader.shown != nil && *fader.shown == frame {
+			return true
+		}
+		fader.shown = &frame
+		if err := frame.send(fader.light); err == ErrWriterStopped {
+			fader.running = false
+			return false
+		}
+		return true
+	}
+
+	transition := fade.transition
+	progress := math.Min(1, float64(time.Since(startedAt))/float64(transition.duration))
+	frame := fadeColors(transition.from, transition.to, progress)
+	fader.shown = &frame
+	if err := frame.send(fader.light); err == ErrWriterStopped {
+		fader.running = false
+		return false
+	}
+	if progress < 1 {
+		return true
+	}
+
+	if transition.powerOff {
+		_ = fader.light.SetPower(false)
+		_ = transition.restore.send(fader.light)
+		fader.shown = &transition.restore
+		fader.on = false
+	}
+	fader.running = false
+	// Read back the status now that the light got there
+	fader.poller.Kick()
+	return false
+}
+
+// Sends the frames of the fades until ctx is cancelled
+func (fader *fader) Run(ctx context.Context) error {
+	var (
+		current   *fade
+		startedAt time.Time
+		index     int
+		ticker    *time.Ticker
+		tick      <-chan time.Time
+	)
+	stopTicker := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+	}
+	defer stopTicker()
+
+	for {
+		select {
+		case current = <-fader.fadeChan:
+			startedAt = time.Now()
+			index = 0
+			if ticker == nil {
+				ticker = time.NewTicker(fader.frameInterval)
+				tick = ticker.C
+			}
+			if !fader.step(current, startedAt, index) {
+				stopTicker()
+			}
+		case <-tick:
+			index++
+			if !fader.step(current, startedAt, index) {
+				stopTicker()
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
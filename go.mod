@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/godbus/dbus v4.1.0+incompatible
 	github.com/muka/go-bluetooth v0.0.0-20200414203147-8d13cd7d087f
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	gopkg.in/yaml.v2 v2.2.8
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Time a supervisor has to answer a ping before it's considered stuck
+	supervisorPingTimeout = 5 * time.Second
+	// How often the status is sent to systemd when the watchdog is not enabled
+	defaultNotifyInterval = 30 * time.Second
+)
+
+// Tells whether the bridge is working: it must be connected to the broker, its supervisors must not be stuck and
+// none of the connected lights may have stopped reporting their status.
+type healthChecker struct {
+	client      *bridgeClient
+	supervisors []*Supervisor
+}
+
+func newHealthChecker(client *bridgeClient, supervisors ...*Supervisor) *healthChecker {
+	return &healthChecker{client: client, supervisors: supervisors}
+}
+
+// Returns nil if the bridge is healthy, along with a short description of its state either way. Gives up waiting for
+// the supervisors when ctx is done.
+func (checker *healthChecker) Check(ctx context.Context) (status string, err error) {
+	connected, total, err := bridgeMetrics.DeviceHealth()
+	status = fmt.Sprintf("%d/%d lights connected", connected, total)
+	if err != nil {
+		return
+	}
+	if !checker.client.IsConnected() {
+		return status, errors.New("not connected to the MQTT broker")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, supervisorPingTimeout)
+	defer cancel()
+	for _, sup := range checker.supervisors {
+		if err := sup.Ping(ctx); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+func (checker *healthChecker) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	status, err := checker.Check(request.Context())
+	if err != nil {
+		response.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(response, "unhealthy: %v (%s)\n", err, status)
+		return
+	}
+	_, _ = fmt.Fprintf(response, "ok (%s)\n", status)
+}
+
+// Sends a notification to systemd through $NOTIFY_SOCKET, see sd_notify(3). Does nothing if the bridge wasn't started
+// by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets start with '@', which the net package takes care of
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Warning("unable to notify systemd: ", err)
+	}
+}
+
+// Returns the watchdog timeout systemd expects pings within, 0 if the watchdog is not enabled for this process
+func getWatchdogTimeout() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Keeps systemd up to date with the status of the bridge until ctx is cancelled. With the watchdog enabled, it's
+// pinged only while the bridge is healthy, so systemd restarts it when it's not.
+func RunSystemdNotifier(ctx context.Context, checker *healthChecker) error {
+	interval := defaultNotifyInterval
+	watchdogTimeout := getWatchdogTimeout()
+	if watchdogTimeout > 0 {
+		// As recommended by sd_watchdog_enabled(3)
+		interval = watchdogTimeout / 2
+		log.Debugf("systemd watchdog enabled, timeout %v", watchdogTimeout)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	unhealthy := false
+	for {
+		status, err := checker.Check(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			if !unhealthy {
+				log.Warning("bridge is unhealthy: ", err)
+			}
+			unhealthy = true
+			notifySystemd(fmt.Sprintf("STATUS=unhealthy: %v (%s)", err, status))
+		case watchdogTimeout > 0:
+			unhealthy = false
+			notifySystemd("STATUS=" + status + "\nWATCHDOG=1")
+		default:
+			unhealthy = false
+			notifySystemd("STATUS=" + status)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Depau/consmart-ble-mqtt/triones"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"path"
+	"sort"
+	"strings"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+// All the discovery object IDs start with this, so stale configs left behind by removed devices can be told apart
+// from other integrations'
+const discoveryObjectIDPrefix = "consmart_"
+
+type haAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+type haDevice struct {
+	Identifiers  []string    `json:"identifiers"`
+	Connections  [][2]string `json:"connections"`
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer"`
+	Model        string      `json:"model"`
+}
+
+// Home Assistant MQTT light discovery payload, JSON schema
+type haLightConfig struct {
+	Name                string           `json:"name"`
+	UniqueID            string           `json:"unique_id"`
+	Schema              string           `json:"schema"`
+	BaseTopic           string           `json:"~"`
+	CommandTopic        string           `json:"command_topic"`
+	StateTopic          string           `json:"state_topic"`
+	Availability        []haAvailability `json:"availability"`
+	AvailabilityMode    string           `json:"availability_mode"`
+	SupportedColorModes []string         `json:"supported_color_modes"`
+	MinMireds           uint16           `json:"min_mireds"`
+	MaxMireds           uint16           `json:"max_mireds"`
+	Effect              bool             `json:"effect"`
+	EffectList          []string         `json:"effect_list"`
+	Device              haDevice         `json:"device"`
+}
+
+func getDiscoveryPrefix(config *Config) string {
+	if config.HomeAssistant != nil && config.HomeAssistant.DiscoveryPrefix != nil {
+		return *config.HomeAssistant.DiscoveryPrefix
+	}
+	return defaultDiscoveryPrefix
+}
+
+func getDiscoveryObjectID(addr string) string {
+	return discoveryObjectIDPrefix + strings.ToLower(strings.Replace(addr, ":", "", -1))
+}
+
+func getDiscoveryTopic(prefix string, addr string) string {
+	return path.Join(prefix, "light", getDiscoveryObjectID(addr), "config")
+}
+
+func getDeviceName(addr string, devMountpoint string) string {
+	if name := path.Base(strings.Trim(devMountpoint, "/")); name != "" && name != "." && name != "/" {
+		return name
+	}
+	return addr
+}
+
+// Settable modes, as shown in Home Assistant's effect list
+func getEffectList() []string {
+	effects := make([]string, 0, len(triones.Modes))
+	for name, mode := range triones.Modes {
+		if mode.IsBuiltIn() {
+			effects = append(effects, name)
+		}
+	}
+	sort.Strings(effects)
+	return effects
+}
+
+func makeDiscoveryPayload(
+	addr string,
+	deviceConfig *DeviceConfig,
+	mountpoint string,
+	devMountpoint string,
+) ([]byte, error) {
+	objectID := getDiscoveryObjectID(addr)
+	name := getDeviceName(addr, devMountpoint)
+	temps := getColorTempSettings(deviceConfig)
+
+	return json.Marshal(haLightConfig{
+		Name:         name,
+		UniqueID:     objectID,
+		Schema:       "json",
+		BaseTopic:    devMountpoint,
+		CommandTopic: "~/control/set",
+		StateTopic:   "~/state",
+		Availability: []haAvailability{
+			{
+				Topic:               path.Join(mountpoint, "online"),
+				PayloadAvailable:    "true",
+				PayloadNotAvailable: "false",
+			},
+			{
+				Topic:               "~/connected",
+				PayloadAvailable:    "true",
+				PayloadNotAvailable: "false",
+			},
+		},
+		AvailabilityMode:    "all",
+		SupportedColorModes: []string{"color_temp", "rgb", "white"},
+		// The warmest temperature has the most mireds
+		MinMireds:  kelvinToMireds(temps.max),
+		MaxMireds:  kelvinToMireds(temps.min),
+		Effect:     true,
+		EffectList: getEffectList(),
+		Device: haDevice{
+			Identifiers:  []string{objectID},
+			Connections:  [][2]string{{"mac", strings.ToLower(addr)}},
+			Name:         name,
+			Manufacturer: "Triones",
+			Model:        "BLE RGB light",
+		},
+	})
+}
+
+// Publishes the retained discovery config for a device
+func PublishDiscovery(
+	client mqtt.Client,
+	prefix string,
+	addr string,
+	deviceConfig *DeviceConfig,
+	mountpoint string,
+	devMountpoint string,
+) {
+	payload, err := makeDiscoveryPayload(addr, deviceConfig, mountpoint, devMountpoint)
+	if err != nil {
+		deviceLogger(mqttLog, addr, devMountpoint).Errorf("unable to build Home Assistant discovery payload: %v", err)
+		return
+	}
+	client.Publish(getDiscoveryTopic(prefix, addr), 1, true, payload)
+}
+
+// Removes the retained discovery config for a device, Home Assistant will then drop the entity
+func RemoveDiscovery(client mqtt.Client, prefix string, addr string) {
+	client.Publish(getDiscoveryTopic(prefix, addr), 1, true, "")
+}
+
+// Watches the retained discovery configs and removes the ones we published for devices that are not in the
+// configuration anymore. isConfigured is called from the MQTT client goroutine. It keeps doing so until the returned
+// topic filter is unsubscribed from.
+func RemoveStaleDiscovery(
+	client mqtt.Client,
+	prefix string,
+	mountpoint string,
+	isConfigured func(objectID string) bool,
+) (topicFilter string) {
+	onlineTopic := path.Join(mountpoint, "online")
+	topicFilter = path.Join(prefix, "light", "+", "config")
+
+	client.Subscribe(topicFilter, 1, func(client mqtt.Client, message mqtt.Message) {
+		objectID := path.Base(path.Dir(message.Topic()))
+		if !strings.HasPrefix(objectID, discoveryObjectIDPrefix) || len(message.Payload()) == 0 {
+			return
+		}
+		if isConfigured(objectID) {
+			return
+		}
+
+		// Make sure it's ours and not from another bridge sharing the broker
+		var config haLightConfig
+		if err := json.Unmarshal(message.Payload(), &config); err != nil {
+			return
+		}
+		if len(config.Availability) == 0 || config.Availability[0].Topic != onlineTopic {
+			return
+		}
+
+		mqttLog.Infof("removing Home Assistant discovery config for '%s', device is not configured anymore", objectID)
+		client.Publish(message.Topic(), 1, true, "")
+	})
+	return
+}
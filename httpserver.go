@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Time given to the requests being served to complete when the server stops
+const httpShutdownTimeout = 5 * time.Second
+
+func newHTTPHandler(checker *healthChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", bridgeMetrics)
+	mux.Handle("/healthz", checker)
+	return mux
+}
+
+// Serves the metrics and the health check until ctx is cancelled, or until the server fails
+func RunHTTPServer(ctx context.Context, config *HTTPConfig, checker *healthChecker) error {
+	server := &http.Server{Addr: config.Listen, Handler: newHTTPHandler(checker)}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+	log.Infof("serving metrics and health check on %s", config.Listen)
+
+	select {
+	case err := <-errChan:
+		return errors.New(fmt.Sprintf("HTTP server stopped: %v", err))
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warning("unable to stop HTTP server cleanly: ", err)
+		}
+		return nil
+	}
+}
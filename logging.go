@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loggers of the subsystems whose level can be set on their own
+var (
+	log = logging.MustGetLogger("bridge")
+	// Bluetooth adapter, connections to the lights and GATT reads and writes
+	bleLog = logging.MustGetLogger("ble")
+	// Broker connection, topics and Home Assistant discovery
+	mqttLog = logging.MustGetLogger("mqtt")
+	// Supervision tree: workers failing, restarting and stopping
+	supervisorLog = logging.MustGetLogger("supervisor")
+)
+
+var logSubsystems = []string{"bridge", "ble", "mqtt", "supervisor"}
+
+const (
+	textLogFormat = "%{time:2006/01/02 15:04:05} %{shortfunc:-15.15s} ▶ %{level:-5.5s} %{module:-10.10s} %{message}"
+	// Same, with the level and everything before it coloured
+	colorLogFormat = "%{time:2006/01/02 15:04:05} %{color}%{shortfunc:-15.15s} ▶ %{level:-5.5s}%{color:reset} " +
+		"%{module:-10.10s} %{message}"
+)
+
+// Warnings and errors waiting to be published to bridge/log. When they pile up, because the bridge can't keep up or
+// isn't connected to the broker, the newer ones are dropped.
+const logForwarderQueueSize = 100
+
+type logField struct {
+	key   string
+	value string
+}
+
+// Message that comes with fields telling what it's about. It's logged as is, text logs get the fields appended to
+// the message as key=value, while JSON logs get them as keys of their own.
+type logEntry struct {
+	message string
+	fields  []logField
+}
+
+func (entry logEntry) String() string {
+	var builder strings.Builder
+	builder.WriteString(entry.message)
+	for _, field := range entry.fields {
+		value := field.value
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		_, _ = fmt.Fprintf(&builder, " %s=%s", field.key, value)
+	}
+	return builder.String()
+}
+
+// Logger that attaches the same fields to everything it logs
+type fieldLogger struct {
+	logger *logging.Logger
+	fields []logField
+}
+
+// Returns a logger for the subsystem that attaches the given key, value pairs to every message
+func withFields(subsystem *logging.Logger, keysAndValues ...string) *fieldLogger {
+	// A logger of its own, so the function reported in the logs is the one calling the fieldLogger and not one of its
+	// methods
+	logger := *subsystem
+	logger.ExtraCalldepth += 2
+	fields := make([]logField, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields = append(fields, logField{keysAndValues[i], keysAndValues[i+1]})
+	}
+	return &fieldLogger{logger: &logger, fields: fields}
+}
+
+// Returns a logger for the subsystem that attaches the address and the mountpoint of a light to every message
+func deviceLogger(subsystem *logging.Logger, addr string, mountpoint string) *fieldLogger {
+	return withFields(subsystem, "address", addr, "mountpoint", mountpoint)
+}
+
+// Returns a logger with the fields of this one and the given one
+func (logger *fieldLogger) With(key string, value string) *fieldLogger {
+	fields := append(append([]logField(nil), logger.fields...), logField{key, value})
+	return &fieldLogger{logger: logger.logger, fields: fields}
+}
+
+// Must be called right by the methods below, so the function reported in the logs is the right one. Messages are
+// only formatted if they're not thrown away.
+func (logger *fieldLogger) log(level logging.Level, message string) {
+	entry := logEntry{message: message, fields: logger.fields}
+	switch level {
+	case logging.ERROR:
+		logger.logger.Error(entry)
+	case logging.WARNING:
+		logger.logger.Warning(entry)
+	case logging.INFO:
+		logger.logger.Info(entry)
+	default:
+		logger.logger.Debug(entry)
+	}
+}
+
+func (logger *fieldLogger) Debug(args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.DEBUG) {
+		logger.log(logging.DEBUG, fmt.Sprint(args...))
+	}
+}
+
+func (logger *fieldLogger) Debugf(format string, args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.DEBUG) {
+		logger.log(logging.DEBUG, fmt.Sprintf(format, args...))
+	}
+}
+
+func (logger *fieldLogger) Info(args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.INFO) {
+		logger.log(logging.INFO, fmt.Sprint(args...))
+	}
+}
+
+func (logger *fieldLogger) Infof(format string, args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.INFO) {
+		logger.log(logging.INFO, fmt.Sprintf(format, args...))
+	}
+}
+
+func (logger *fieldLogger) Warning(args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.WARNING) {
+		logger.log(logging.WARNING, fmt.Sprint(args...))
+	}
+}
+
+func (logger *fieldLogger) Warningf(format string, args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.WARNING) {
+		logger.log(logging.WARNING, fmt.Sprintf(format, args...))
+	}
+}
+
+func (logger *fieldLogger) Error(args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.ERROR) {
+		logger.log(logging.ERROR, fmt.Sprint(args...))
+	}
+}
+
+func (logger *fieldLogger) Errorf(format string, args ...interface{}) {
+	if logger.logger.IsEnabledFor(logging.ERROR) {
+		logger.log(logging.ERROR, fmt.Sprintf(format, args...))
+	}
+}
+
+// Turns a record into what's written to JSON logs and published to bridge/log
+func makeLogRecord(rec *logging.Record) map[string]interface{} {
+	record := map[string]interface{}{
+		"time":      rec.Time.Format(time.RFC3339Nano),
+		"level":     strings.ToLower(rec.Level.String()),
+		"subsystem": rec.Module,
+	}
+	if len(rec.Args) == 1 {
+		if entry, ok := rec.Args[0].(logEntry); ok {
+			record["message"] = entry.message
+			for _, field := range entry.fields {
+				record[field.key] = field.value
+			}
+			return record
+		}
+	}
+	record["message"] = rec.Message()
+	return record
+}
+
+// Writes one JSON object per line
+type jsonLogBackend struct {
+	lock *sync.Mutex
+	out  io.Writer
+}
+
+func (backend jsonLogBackend) Log(_ logging.Level, _ int, rec *logging.Record) error {
+	line, err := json.Marshal(makeLogRecord(rec))
+	if err != nil {
+		return err
+	}
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	_, err = backend.out.Write(append(line, '\n'))
+	return err
+}
+
+// Publishes warnings and errors to bridge/log. Records are queued as they're logged and published by Run, since
+// they can be logged while the MQTT client holds its own lock.
+type logForwarder struct {
+	records chan []byte
+	dropped *uint64
+}
+
+func newLogForwarder() *logForwarder {
+	return &logForwarder{
+		records: make(chan []byte, logForwarderQueueSize),
+		dropped: new(uint64),
+	}
+}
+
+func (forwarder *logForwarder) Log(level logging.Level, _ int, rec *logging.Record) error {
+	if level > logging.WARNING {
+		return nil
+	}
+	payload, err := json.Marshal(makeLogRecord(rec))
+	if err != nil {
+		return err
+	}
+	select {
+	case forwarder.records <- payload:
+	default:
+		atomic.AddUint64(forwarder.dropped, 1)
+	}
+	return nil
+}
+
+// Publishes the queued records until ctx is cancelled
+func (forwarder *logForwarder) Run(ctx context.Context, client *bridgeClient) error {
+	for {
+		select {
+		case payload := <-forwarder.records:
+			// Failures are not logged, they'd end up here again
+			client.PublishLog(payload)
+			if dropped := atomic.SwapUint64(forwarder.dropped, 0); dropped > 0 {
+				payload, _ := json.Marshal(map[string]interface{}{
+					"time":      time.Now().Format(time.RFC3339Nano),
+					"level":     "warning",
+					"subsystem": log.Module,
+					"message":   fmt.Sprintf("%d log messages were dropped", dropped),
+				})
+				client.PublishLog(payload)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func getLogLevel(level string) (logging.Level, error) {
+	// go-logging knows about "warning" but not "warn"
+	if strings.EqualFold(level, "warn") {
+		level = "warning"
+	}
+	return logging.LogLevel(level)
+}
+
+func validateLoggingConfig(config *LoggingConfig) error {
+	if config.Level != nil {
+		if _, err := getLogLevel(*config.Level); err != nil {
+			return errors.New(fmt.Sprintf("invalid log level '%s'", *config.Level))
+		}
+	}
+SubsystemsLoop:
+	for subsystem, level := range config.Subsystems {
+		if _, err := getLogLevel(level); err != nil {
+			return errors.New(fmt.Sprintf("invalid log level '%s' for '%s'", level, subsystem))
+		}
+		for _, known := range logSubsystems {
+			if subsystem == known {
+				continue SubsystemsLoop
+			}
+		}
+		return errors.New(fmt.Sprintf("unknown log subsystem '%s', must be one of %s",
+			subsystem, strings.Join(logSubsystems, ", ")))
+	}
+	if config.Format != nil && *config.Format != "text" && *config.Format != "json" {
+		return errors.New(fmt.Sprintf("invalid log format '%s', must be text or json", *config.Format))
+	}
+	return nil
+}
+
+// Sets up the log output and levels, with the defaults if config is nil. The config is expected to be valid. Returns
+// the forwarder of warnings and errors to MQTT if it's enabled, it holds on to them until it's run.
+func setUpLogging(config *LoggingConfig) *logForwarder {
+	if config == nil {
+		config = &LoggingConfig{}
+	}
+
+	var backends []logging.Backend
+	if config.Format != nil && *config.Format == "json" {
+		backends = append(backends, jsonLogBackend{lock: &sync.Mutex{}, out: os.Stderr})
+	} else {
+		// Colours are only noise in journals and files
+		format := textLogFormat
+		if isTerminal(os.Stderr) {
+			format = colorLogFormat
+		}
+		backends = append(backends,
+			logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), logging.MustStringFormatter(format)))
+	}
+	var forwarder *logForwarder
+	if config.ForwardToMQTT {
+		forwarder = newLogForwarder()
+		backends = append(backends, forwarder)
+	}
+	leveled := logging.SetBackend(backends...)
+
+	level := logging.DEBUG
+	if config.Level != nil {
+		level, _ = getLogLevel(*config.Level)
+	}
+	leveled.SetLevel(level, "")
+	for subsystem, subsystemLevel := range config.Subsystems {
+		level, _ := getLogLevel(subsystemLevel)
+		leveled.SetLevel(level, subsystem)
+	}
+	return forwarder
+}
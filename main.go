@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Depau/consmart-ble-mqtt/triones"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	adapter1 "github.com/muka/go-bluetooth/bluez/profile/adapter"
 	device2 "github.com/muka/go-bluetooth/bluez/profile/device"
-	"github.com/op/go-logging"
+	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"runtime"
-	"strings"
 	"syscall"
 	"time"
 )
@@ -18,261 +22,293 @@ import (
 const RGBCharUUID string = "0000ffd9-0000-1000-8000-00805f9b34fb"
 const NotifyCharUUID string = "0000ffd4-0000-1000-8000-00805f9b34fb"
 
-var log = logging.MustGetLogger("consmart-ble-mqtt")
-var format = logging.MustStringFormatter(
-	`%{color}%{shortfunc:-15.15s} ▶ %{level:.5s}%{color:reset} %{message}`,
-)
+// Seconds to wait for BlueZ to resolve the services of a connected device
+const servicesResolvedAttempts = 20
 
-func signalHandler(signal chan os.Signal, stopRope StopRope) {
+func signalHandler(signal chan os.Signal, stop context.CancelFunc, reload func() error) {
 	for {
-		sig := <-signal
-		if sig == syscall.SIGQUIT {
+		switch sig := <-signal; sig {
+		case syscall.SIGQUIT:
 			buf := make([]byte, 1<<20)
 			stacklen := runtime.Stack(buf, true)
 			log.Debugf("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end", buf[:stacklen])
-		} else {
-			stopRope.Cut()
+		case syscall.SIGHUP:
+			// Don't hold up the other signals while the config is being reloaded
+			go func() {
+				// Reload logs the outcome
+				_ = reload()
+			}()
+		default:
+			stop()
 			return
 		}
 	}
-
 }
 
-func getAdapterOrDie(config *Config) (adapter *adapter1.Adapter1) {
-	var err error
-
+// Returns the configured adapter, or the default one
+func getAdapter(config *Config) (*adapter1.Adapter1, error) {
 	if config.Bluetooth != nil && config.Bluetooth.Adapter != nil {
-		adapter, err = adapter1.GetAdapter(*config.Bluetooth.Adapter)
-		if err != nil {
-			log.Fatalf("unable to get adapter '%s': %v\n", *config.Bluetooth.Adapter, err)
-		}
-	} else {
-		adapter, err = adapter1.GetDefaultAdapter()
+		adapter, err := adapter1.GetAdapter(*config.Bluetooth.Adapter)
 		if err != nil {
-			log.Fatal("unable to retrieve default adapter", err)
+			return nil, errors.New(fmt.Sprintf("unable to get adapter '%s': %v", *config.Bluetooth.Adapter, err))
 		}
+		return adapter, nil
 	}
-
-	return
-}
-
-func requestDeviceUpdates(bleLight *BleLight, stopRope StopRope, bluetoothResetChan chan bool) {
-	if err := stopRope.Hold(); err != nil {
-		return
+	adapter, err := adapter1.GetDefaultAdapter()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to retrieve default adapter: %v", err))
 	}
-	defer stopRope.Release()
+	return adapter, nil
+}
 
-	for {
-		select {
-		case <-stopRope.WaitCut():
-			return
-		case <-time.After(1 * time.Second):
-			err := (*bleLight).RequestLightStatus()
-			if err != nil {
-				if strings.Contains(err.Error(), "Input/output error") {
-					bluetoothResetChan <- true
-					log.Error("failed to request light status, bluetooth needs reset: ", err)
-				} else {
-					log.Error("failed to request light status, closing: ", err)
-				}
-				stopRope.Cut()
-				return
-			}
-		}
+func getAdapterOrDie(config *Config) *adapter1.Adapter1 {
+	adapter, err := getAdapter(config)
+	if err != nil {
+		bleLog.Fatal(err)
 	}
+	return adapter
 }
 
-func handleDeviceForever(
-	adapter *adapter1.Adapter1,
+// Exposes a connected light over MQTT until ctx is cancelled, which returns nil, or until one of the workers serving
+// it fails. They can't work without each other, so they're all stopped as soon as one of them fails.
+func serveLight(
+	ctx context.Context,
+	transport Transport,
 	addr string,
-	deviceConfig DeviceConfig,
+	deviceConfig *DeviceConfig,
 	mountpoint string,
 	mqttClient mqtt.Client,
-	stopRope StopRope,
-	bluetoothResetChan chan bool,
-) {
-	if err := stopRope.Hold(); err != nil {
-		return
-	}
-	defer stopRope.Release()
-
+	states *stateStore,
+	bluetoothResetChan chan<- bool,
+	watchers ...ChildSpec,
+) error {
 	connectedTopic := path.Join(mountpoint, "connected")
 	colorTopic := path.Join(mountpoint, "control/color")
+	hsvTopic := path.Join(mountpoint, "control/hsv")
+	brightnessTopic := path.Join(mountpoint, "control/brightness")
+	colorTempTopic := path.Join(mountpoint, "control/color_temp")
 	modeTopic := path.Join(mountpoint, "control/mode")
 	powerTopic := path.Join(mountpoint, "control/power")
-
-	defer mqttClient.Publish(connectedTopic, 1, true, "false")
-
-OuterLoop:
-	for {
-		if stopRope.IsCut() {
-			break OuterLoop
+	setTopic := path.Join(mountpoint, "control/set")
+
+	statusChan := make(chan LightStatus)
+	reconcileChan := make(chan LightStatus)
+	publishChan := make(chan LightStatus)
+	frameErrorChan := make(chan *triones.FrameError, 1)
+	metrics := bridgeMetrics.Device(addr)
+	deviceLog := deviceLogger(bleLog, addr, mountpoint)
+	commandLog := deviceLogger(mqttLog, addr, mountpoint)
+	bleLight := NewBleLight(transport, statusChan, frameErrorChan, getMinWriteInterval(deviceConfig), metrics,
+		getCalibration(deviceConfig), deviceLog,
+	)
+	poller := newStatusPoller(bleLight, deviceConfig, statusChan, reconcileChan, bluetoothResetChan)
+	fader := newFader(bleLight, poller, deviceConfig)
+	temps := getColorTempSettings(deviceConfig)
+	reconciler := newReconciler(
+		addr, deviceConfig, mountpoint, mqttClient, deviceLog, reconcileChan, publishChan,
+	)
+	controller := newLightController(bleLight, poller, fader, temps, addr, states, reconciler)
+
+	connection := NewSupervisor(fmt.Sprintf("light '%s'", addr), OneForAll, 0, 0, 0)
+	workers := []ChildSpec{
+		{Name: "writer", Run: bleLight.RunWriter},
+		{Name: "notifications", Run: bleLight.ListenNotifications},
+		{Name: "publisher", Run: func(ctx context.Context) error {
+			return StatusChanPublisher(ctx, mountpoint, &mqttClient, publishChan, frameErrorChan, metrics, temps)
+		}},
+		{Name: "poller", Run: poller.Run},
+		{Name: "fader", Run: fader.Run},
+		{Name: "reconciler", Run: func(ctx context.Context) error {
+			return reconciler.Run(ctx, controller)
+		}},
+	}
+	for _, worker := range append(workers, watchers...) {
+		if err := connection.Add(worker); err != nil {
+			return err
 		}
+	}
 
-		device, err := adapter.GetDeviceByAddress(addr)
-		if err != nil {
-			log.Errorf("unable to get device '%s': %v", addr, err)
-			return
+	mqttClient.Subscribe(colorTopic, 2, GetMessageHandlerSetColor(controller, commandLog))
+	mqttClient.Subscribe(hsvTopic, 2, GetMessageHandlerSetHSV(controller, commandLog))
+	mqttClient.Subscribe(brightnessTopic, 2, GetMessageHandlerSetBrightness(controller, commandLog))
+	mqttClient.Subscribe(colorTempTopic, 2, GetMessageHandlerSetColorTemp(controller, commandLog))
+	mqttClient.Subscribe(modeTopic, 2, GetMessageHandlerSetMode(controller, commandLog))
+	mqttClient.Subscribe(powerTopic, 2, GetMessageHandlerSetPower(controller, commandLog))
+	mqttClient.Subscribe(setTopic, 2, GetMessageHandlerSetJSON(controller, commandLog))
+
+	mqttClient.Publish(connectedTopic, 1, true, "true")
+	deviceLog.Info("successfully connected")
+	metrics.Connected(mountpoint, getStatusTimeout(deviceConfig))
+
+	// Sent as soon as the writer starts
+	if deviceConfig.PowerOnBehavior != nil {
+		if command, err := controller.ApplyPowerOnBehavior(*deviceConfig.PowerOnBehavior); err != nil {
+			deviceLog.Error("unable to apply power on behavior: ", err)
+		} else if command != nil {
+			deviceLog.Debugf("applied power on behavior '%s'", *deviceConfig.PowerOnBehavior)
 		}
+	}
 
-		log.Debugf("connecting to '%s'...", addr)
+	err := connection.Run(ctx)
+	metrics.Disconnected()
 
-		if ok, err := device.GetConnected(); !ok {
-			err := device.Connect()
-			if err != nil {
-				if strings.Contains(err.Error(), "Input/output error") {
-					bluetoothResetChan <- true
-					log.Error("unable to connect, bluetooth needs reset: ", err)
-					stopRope.Cut()
-					return
-				}
-				log.Errorf("unable to connect device '%s', will retry in 5 sec: %v", addr, err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-		} else if err != nil {
-			log.Errorf("unable to check whether device '%s' is connected: %v", addr, err)
-			return
-		}
+	mqttClient.Unsubscribe(colorTopic, hsvTopic, brightnessTopic, colorTempTopic, modeTopic, powerTopic, setTopic)
+	mqttClient.Publish(connectedTopic, 1, true, "false")
+	if badFrames := bleLight.BadFrames(); badFrames > 0 {
+		deviceLog.Warningf("received %d notifications that could not be decoded", badFrames)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("connection to '%s' lost: %v", addr, err))
+	}
+	return nil
+}
 
-		log.Debugf("connected to '%s', waiting for services...", addr)
+// Connects to the device and serves it until ctx is cancelled or the connection is lost. The caller is expected to
+// retry, see newDeviceSpec.
+func connectAndServe(
+	ctx context.Context,
+	adapter *adapter1.Adapter1,
+	addr string,
+	deviceConfig *DeviceConfig,
+	mountpoint string,
+	mqttClient mqtt.Client,
+	states *stateStore,
+	bluetoothResetChan chan<- bool,
+	characteristics *characteristicsCache,
+) error {
+	device, err := adapter.GetDeviceByAddress(addr)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to get device '%s': %v", addr, err))
+	}
 
-		attempts := 0
-		for resolved, err := device.GetServicesResolved(); !resolved; attempts++ {
-			if err != nil {
-				log.Errorf("unable to check whether services were resolved for '%s': %v", addr, err)
-			}
-			if attempts >= 20 {
-				log.Errorf("unable to check whether services were resolved for '%s' after %d attempts", addr, attempts)
-				continue OuterLoop
+	deviceLog := deviceLogger(bleLog, addr, mountpoint)
+	deviceLog.Debug("connecting...")
+
+	if ok, err := device.GetConnected(); err != nil {
+		device.Close()
+		return errors.New(fmt.Sprintf("unable to check whether device '%s' is connected: %v", addr, err))
+	} else if !ok {
+		if err := device.Connect(); err != nil {
+			device.Close()
+			if isIOError(err) {
+				bridgeMetrics.BluetoothIOError()
+				requestBluetoothReset(bluetoothResetChan)
+				return errors.New(fmt.Sprintf("unable to connect device '%s', bluetooth needs reset: %v", addr, err))
 			}
-			time.Sleep(1 * time.Second)
-		}
-
-		rgbCharUUID := RGBCharUUID
-		notifyCharUUID := NotifyCharUUID
-
-		if deviceConfig.RGBCharacteristic != nil {
-			rgbCharUUID = *deviceConfig.RGBCharacteristic
-		}
-		if deviceConfig.NotifyCharacteristic != nil {
-			notifyCharUUID = *deviceConfig.NotifyCharacteristic
-		}
-
-		rgbChar, err := device.GetCharByUUID(rgbCharUUID)
-		if err != nil {
-			log.Errorf("unable to retrieve RGB characteristic for '%s': %v", addr, err)
-			logCharacteristics(device)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		notifyChar, err := device.GetCharByUUID(notifyCharUUID)
-		if err != nil {
-			log.Errorf("unable to retrieve notifications characteristic for '%s': %v", addr, err)
-			logCharacteristics(device)
-			time.Sleep(1 * time.Second)
-			continue
+			return errors.New(fmt.Sprintf("unable to connect device '%s': %v", addr, err))
 		}
+	}
+	defer disconnectDevice(device)
 
-		statusChan := make(chan LightStatus)
-		deviceStopRope := NewRope()
-		bleLight := NewBleLight(rgbChar, notifyChar, statusChan, deviceStopRope)
+	deviceLog.Debug("connected, waiting for services...")
 
-		mqttClient.Subscribe(colorTopic, 2, GetMessageHandlerSetColor(&bleLight))
-		mqttClient.Subscribe(modeTopic, 2, GetMessageHandlerSetMode(&bleLight))
-		mqttClient.Subscribe(powerTopic, 2, GetMessageHandlerSetPower(&bleLight))
+	if resolved, err := waitServicesResolved(ctx, device, addr); err != nil {
+		return err
+	} else if !resolved {
+		return nil
+	}
 
-		go requestDeviceUpdates(&bleLight, deviceStopRope, bluetoothResetChan)
-		go StatusChanPublisher(mountpoint, &mqttClient, statusChan, deviceStopRope)
+	rgbChar, notifyChar, err := resolveCharacteristics(device, addr, deviceConfig, characteristics)
+	if err != nil {
+		return err
+	}
 
-		mqttClient.Publish(connectedTopic, 1, true, "true")
-		log.Infof("successfully connected to '%s'", addr)
+	transport := NewBluezTransport(rgbChar, notifyChar)
+	return serveLight(
+		ctx, transport, addr, deviceConfig, mountpoint, mqttClient, states, bluetoothResetChan,
+		ChildSpec{Name: "connection watcher", Run: func(ctx context.Context) error {
+			return watchDeviceConnection(ctx, device)
+		}},
+	)
+}
 
-		err = bleLight.ListenNotifications()
+// Waits for BlueZ to resolve the services of a connected device. Returns false without an error if ctx is cancelled
+// in the meantime.
+func waitServicesResolved(ctx context.Context, device *device2.Device1, addr string) (bool, error) {
+	for attempts := 0; ; attempts++ {
+		resolved, err := device.GetServicesResolved()
 		if err != nil {
-			log.Errorf("error while listening for notifications from '%s': %v", addr, err)
+			withFields(bleLog, "address", addr).Errorf("unable to check whether services were resolved: %v", err)
 		}
-
-		select {
-		case <-stopRope.WaitCut():
-			// Global stop signal, disconnect
-			deviceStopRope.Cut()
-			deviceStopRope.WaitReleased()
-			disconnectDevice(device)
-			mqttClient.Unsubscribe(colorTopic, modeTopic, powerTopic)
-			break OuterLoop
-		case <-deviceStopRope.WaitCut():
-			// Device disconnected, attempt reconnection
-			log.Warningf("connection to '%s' lost, attempting reconnection...", addr)
-			deviceStopRope.WaitReleased()
+		if resolved {
+			return true, nil
+		}
+		if attempts >= servicesResolvedAttempts {
+			return false, errors.New(fmt.Sprintf("unable to check whether services were resolved for '%s' after %d attempts", addr, attempts))
+		}
+		if !sleepContext(ctx, 1*time.Second) {
+			return false, nil
 		}
-
-		disconnectDevice(device)
-		mqttClient.Unsubscribe(colorTopic, modeTopic, powerTopic)
 	}
+}
 
+// Keeps the device connected for as long as the devices supervisor runs. Failures only ever affect this device: the
+// supervisor retries the connection with exponential backoff, so other lights keep working.
+func newDeviceSpec(
+	adapter *adapter1.Adapter1,
+	addr string,
+	settings deviceSettingsFunc,
+	characteristics *characteristicsCache,
+	mqttClient mqtt.Client,
+	states *stateStore,
+	bluetoothResetChan chan<- bool,
+	simulate bool,
+) ChildSpec {
+	spec := ChildSpec{Name: deviceChildName(addr), Restart: Permanent}
+	if simulate {
+		// The bulb keeps its state across reconnections, like a real one would
+		transport := NewSimulatedBulb()
+		spec.Run = func(ctx context.Context) error {
+			deviceConfig, mountpoint := settings()
+			return serveLight(ctx, transport, addr, &deviceConfig, mountpoint, mqttClient, states, bluetoothResetChan)
+		}
+	} else {
+		spec.Run = func(ctx context.Context) error {
+			deviceConfig, mountpoint := settings()
+			return connectAndServe(
+				ctx, adapter, addr, &deviceConfig, mountpoint, mqttClient, states, bluetoothResetChan, characteristics,
+			)
+		}
+	}
+	return spec
 }
 
 func disconnectDevice(device *device2.Device1) {
 	addr, _ := device.GetAddress()
-	log.Debugf("disconnecting '%s'", addr)
+	deviceLog := withFields(bleLog, "address", addr)
+	deviceLog.Debug("disconnecting")
 	err := device.Disconnect()
 	if err != nil {
-		log.Errorf("unable to disconnect device on stop '%s': %v", addr, err)
+		deviceLog.Errorf("unable to disconnect device on stop: %v", err)
 	}
 	device.Close()
 }
 
-func main() {
-	var (
-		config  Config
-		adapter *adapter1.Adapter1
-		err     error
-	)
-	logging.SetFormatter(format)
-
-	if len(os.Args) != 2 {
-		log.Fatalf("usage: %s [config]", os.Args[0])
-	}
-
-	config, err = ReadConfig(os.Args[1])
-	if err != nil {
-		log.Fatal("unable to read config: ", err)
-	}
-
-	stopRope := NewRope()
-
-	mqttClient, err := ConnectClient(&config.MQTT)
-	if err != nil {
-		log.Fatal("unable to connect to MQTT broker: ", err)
-	}
-	defer mqttClient.Disconnect(0)
-	log.Debug("connected to MQTT broker")
-
-	mountpoint := "/"
-	if config.MQTT.MountPoint != nil {
-		mountpoint = *config.MQTT.MountPoint
-	}
-
-	adapter = getAdapterOrDie(&config)
-	defer adapter.Close()
+func getPoweredAdapterOrDie(config *Config) *adapter1.Adapter1 {
+	adapter := getAdapterOrDie(config)
 	name, _ := adapter.GetAdapterID()
-	log.Debugf("Bluetooth adapter: %s", name)
+	bleLog.Debugf("Bluetooth adapter: %s", name)
 
 	if powered, _ := adapter.GetPowered(); !powered {
-		log.Info("turning Bluetooth adapter on...")
+		bleLog.Info("turning Bluetooth adapter on...")
 		if err := adapter.SetPowered(true); err != nil {
-			log.Fatal("unable to turn on adapter: ", err)
+			bleLog.Fatal("unable to turn on adapter: ", err)
 		}
 	}
+	return adapter
+}
+
+// Gets the adapter ready and waits a bit for the configured devices to show up
+func setUpAdapter(config *Config) *adapter1.Adapter1 {
+	adapter := getPoweredAdapterOrDie(config)
 
-	log.Debug("waiting for one device to be discovered")
+	bleLog.Debug("waiting for one device to be discovered")
 	if err := adapter.StartDiscovery(); err != nil {
-		log.Warning("failed to start discovery")
+		bleLog.Warning("failed to start discovery")
 	}
 	scanChan, cancel, err := adapter.OnDeviceDiscovered()
 	if err != nil {
-		log.Fatal("failed to retrieve discovered devices channel: ", err)
+		bleLog.Fatal("failed to retrieve discovered devices channel: ", err)
 	}
 DiscoveryLoop:
 	for {
@@ -280,59 +316,173 @@ DiscoveryLoop:
 		case discoveredDev := <-scanChan:
 			device, err := device2.NewDevice1(discoveredDev.Path)
 			if err != nil {
-				log.Errorf("failed to retrieve discovered device '%s': %v", discoveredDev.Path, err)
+				bleLog.Errorf("failed to retrieve discovered device '%s': %v", discoveredDev.Path, err)
 				continue DiscoveryLoop
 			}
 			addr, _ := device.GetAddress()
 			if _, ok := config.Devices[addr]; ok {
-				log.Debugf("found device '%s', proceeding", addr)
+				withFields(bleLog, "address", addr).Debug("found device, proceeding")
 				break DiscoveryLoop
 			}
 		case <-time.After(3 * time.Second):
-			log.Warning("timeout, proceeding anyway")
+			bleLog.Warning("timeout, proceeding anyway")
 			break DiscoveryLoop
 		}
 	}
 	cancel()
 	_ = adapter.StopDiscovery()
 
-	bluetoothResetChan := make(chan bool)
+	return adapter
+}
+
+func main() {
+	var (
+		config  Config
+		adapter *adapter1.Adapter1
+		err     error
+	)
+	setUpLogging(nil)
+	rand.Seed(time.Now().UnixNano())
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scan":
+			os.Exit(runScan(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		}
+	}
 
-	for addr, deviceConfig := range config.Devices {
-		devMountpoint := path.Join(mountpoint, deviceConfig.MountPoint)
-		go handleDeviceForever(adapter, addr, deviceConfig, devMountpoint, mqttClient, stopRope, bluetoothResetChan)
+	simulate := flag.Bool("simulate", false, "use simulated lights instead of Bluetooth ones")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [--simulate] [config]\n       %s scan [--timeout duration]\n       %s doctor [config]\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
 	}
 
+	config, err = ReadConfig(flag.Arg(0))
+	if err != nil {
+		log.Fatal("unable to read config: ", err)
+	}
+	if err := ValidateConfig(&config); err != nil {
+		log.Fatal("invalid config: ", err)
+	}
+	logForwarder := setUpLogging(config.Logging)
+
+	stateFile := ""
+	if config.StateFile != nil {
+		stateFile = *config.StateFile
+	}
+	states, err := newStateStore(stateFile)
+	if err != nil {
+		log.Fatal("unable to load the state of the lights: ", err)
+	}
+
+	mqttClient, err := ConnectClient(&config.MQTT)
+	if err != nil {
+		mqttLog.Fatal("unable to connect to MQTT broker: ", err)
+	}
+	defer mqttClient.Disconnect(0)
+	mqttLog.Debug("connected to MQTT broker")
+	bridgeMetrics.SetMQTTClient(mqttClient)
+
+	if *simulate {
+		log.Warning("using simulated lights")
+	} else {
+		adapter = setUpAdapter(&config)
+		defer adapter.Close()
+	}
+
+	bluetoothResetChan := make(chan bool, 1)
+
+	devices := NewSupervisor("devices", OneForOne, unlimitedRestarts, minReconnectDelay, maxReconnectDelay)
+	newSpec := func(addr string, settings deviceSettingsFunc, characteristics *characteristicsCache) ChildSpec {
+		return newDeviceSpec(adapter, addr, settings, characteristics, mqttClient, states, bluetoothResetChan, *simulate)
+	}
+	manager, err := newDeviceManager(flag.Arg(0), config, mqttClient, states, devices, newSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The manager is stopped first, so devices aren't added while they're being stopped
+	bridge := NewSupervisor("bridge", OneForOne, unlimitedRestarts, minReconnectDelay, maxReconnectDelay)
+	_ = bridge.Add(ChildSpec{Name: "devices", Restart: Permanent, Run: devices.Run})
+	_ = bridge.Add(ChildSpec{Name: "device manager", Restart: Permanent, Run: manager.Run})
+
+	if stateFile != "" {
+		_ = bridge.Add(ChildSpec{Name: "state store", Restart: Permanent, Run: states.Run})
+	}
+	if logForwarder != nil {
+		_ = bridge.Add(ChildSpec{Name: "log forwarder", Restart: Permanent, Run: func(ctx context.Context) error {
+			return logForwarder.Run(ctx, mqttClient)
+		}})
+	}
+
+	checker := newHealthChecker(mqttClient, bridge, devices)
+	if config.HTTP != nil {
+		httpConfig := *config.HTTP
+		_ = bridge.Add(ChildSpec{Name: "HTTP server", Restart: Permanent, Run: func(ctx context.Context) error {
+			return RunHTTPServer(ctx, &httpConfig, checker)
+		}})
+	}
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		_ = bridge.Add(ChildSpec{Name: "systemd notifier", Restart: Permanent, Run: func(ctx context.Context) error {
+			return RunSystemdNotifier(ctx, checker)
+		}})
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	bridgeDone := make(chan error, 1)
+	go func() {
+		bridgeDone <- bridge.Run(ctx)
+	}()
+	notifySystemd("READY=1")
+
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
-	go signalHandler(signalChan, stopRope)
+	go signalHandler(signalChan, stop, manager.Reload)
 
-	<-stopRope.WaitCut()
+	resetBluetooth := false
+MainLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break MainLoop
+		case <-bluetoothResetChan:
+			// The adapter is shared by all the lights, there's no point in carrying on without resetting it
+			if config.Bluetooth != nil && config.Bluetooth.ResetProgram != nil {
+				bleLog.Warning("bluetooth reset was requested, stopping")
+				resetBluetooth = true
+				break MainLoop
+			}
+			bleLog.Warning("bluetooth reset was requested, but it was not configured; please reset manually")
+		}
+	}
 
-	select {
-	case <-stopRope.WaitReleased():
-	case <-time.After(5 * time.Second):
-		log.Warning("timed out waiting for all goroutines to stop, potential deadlock")
+	// Stops every device, in turn every connection to a light, and waits for all of them
+	notifySystemd("STOPPING=1")
+	stop()
+	if err := <-bridgeDone; err != nil {
+		log.Error("bridge stopped: ", err)
 	}
+	log.Debug("all devices stopped")
 
-	select {
-	case <-bluetoothResetChan:
-		if config.Bluetooth != nil && config.Bluetooth.ResetProgram != nil {
-			log.Warning("bluetooth reset was requested, resetting")
-			if err := exec.Command(*config.Bluetooth.ResetProgram); err != nil {
-				log.Error("unable to reset bluetooth: ", err)
-			} else {
-				time.Sleep(5 * time.Second)
-				log.Info("bluetooth reset, exiting")
-			}
+	if resetBluetooth {
+		bleLog.Warning("resetting bluetooth")
+		if err := exec.Command(*config.Bluetooth.ResetProgram).Run(); err != nil {
+			bleLog.Error("unable to reset bluetooth: ", err)
 		} else {
-			log.Warning("bluetooth reset was requested, but it was not configured; please reset manually")
+			time.Sleep(5 * time.Second)
+			bleLog.Info("bluetooth reset, exiting")
 		}
-	default:
-		break
 	}
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the GATT write latency histogram buckets, in seconds
+var writeLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics of the whole bridge, served in the Prometheus text format
+var bridgeMetrics = newMetricsRegistry()
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (hist *histogram) Observe(value float64) {
+	for i, bound := range hist.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+// Metrics of a single light. They outlive the connection to the light, so counters keep counting across
+// reconnections. All the methods can be called on a nil *deviceMetrics, which does nothing.
+type deviceMetrics struct {
+	lock        *sync.Mutex
+	mountpoint  string
+	connected   bool
+	connectedAt time.Time
+	connections uint64
+	// The light is considered stuck if it's connected but doesn't report its status for this long
+	statusTimeout time.Duration
+	lastStatus    time.Time
+	writeLatency  histogram
+	writeErrors   uint64
+	badFrames     uint64
+	// Last status received from the light, only meaningful if lastStatus is set
+	status LightStatus
+}
+
+// Metrics of the Bluetooth adapter, the MQTT connection and every light
+type metricsRegistry struct {
+	lock    *sync.Mutex
+	devices map[string]*deviceMetrics
+	mqtt    *bridgeClient
+
+	mqttReceived           *uint64
+	mqttPublished          *uint64
+	bluetoothIOErrors      *uint64
+	bluetoothResetRequests *uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		lock:                   &sync.Mutex{},
+		devices:                make(map[string]*deviceMetrics),
+		mqttReceived:           new(uint64),
+		mqttPublished:          new(uint64),
+		bluetoothIOErrors:      new(uint64),
+		bluetoothResetRequests: new(uint64),
+	}
+}
+
+// Returns the metrics of the device, creating them the first time
+func (registry *metricsRegistry) Device(addr string) *deviceMetrics {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	metrics, ok := registry.devices[addr]
+	if !ok {
+		metrics = &deviceMetrics{lock: &sync.Mutex{}, writeLatency: newHistogram(writeLatencyBuckets)}
+		registry.devices[addr] = metrics
+	}
+	return metrics
+}
+
+// Stops reporting a device that is not configured anymore
+func (registry *metricsRegistry) RemoveDevice(addr string) {
+	registry.lock.Lock()
+	delete(registry.devices, addr)
+	registry.lock.Unlock()
+}
+
+func (registry *metricsRegistry) SetMQTTClient(client *bridgeClient) {
+	registry.lock.Lock()
+	registry.mqtt = client
+	registry.lock.Unlock()
+}
+
+func (registry *metricsRegistry) MQTTMessageReceived() {
+	atomic.AddUint64(registry.mqttReceived, 1)
+}
+
+func (registry *metricsRegistry) MQTTMessagePublished() {
+	atomic.AddUint64(registry.mqttPublished, 1)
+}
+
+func (registry *metricsRegistry) BluetoothIOError() {
+	atomic.AddUint64(registry.bluetoothIOErrors, 1)
+}
+
+func (registry *metricsRegistry) BluetoothResetRequested() {
+	atomic.AddUint64(registry.bluetoothResetRequests, 1)
+}
+
+func (metrics *deviceMetrics) Connected(mountpoint string, statusTimeout time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.mountpoint = mountpoint
+	metrics.connected = true
+	metrics.connectedAt = time.Now()
+	metrics.connections++
+	metrics.statusTimeout = statusTimeout
+	metrics.lock.Unlock()
+}
+
+func (metrics *deviceMetrics) Disconnected() {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.connected = false
+	metrics.lock.Unlock()
+}
+
+func (metrics *deviceMetrics) StatusReceived(status *LightStatus) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.lastStatus = time.Now()
+	metrics.status = *status
+	metrics.lock.Unlock()
+}
+
+func (metrics *deviceMetrics) Written(duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.writeLatency.Observe(duration.Seconds())
+	if err != nil {
+		metrics.writeErrors++
+	}
+	metrics.lock.Unlock()
+}
+
+func (metrics *deviceMetrics) BadFrame() {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.badFrames++
+	metrics.lock.Unlock()
+}
+
+// Returns how many of the devices are connected, and an error if any of them is connected but stopped reporting its
+// status
+func (registry *metricsRegistry) DeviceHealth() (connected int, total int, err error) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	addrs := make([]string, 0, len(registry.devices))
+	for addr := range registry.devices {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		metrics := registry.devices[addr]
+		metrics.lock.Lock()
+		if metrics.connected {
+			connected++
+			since := metrics.connectedAt
+			if metrics.lastStatus.After(since) {
+				since = metrics.lastStatus
+			}
+			if silent := time.Since(since); silent > metrics.statusTimeout && err == nil {
+				err = errors.New(fmt.Sprintf("light '%s' is connected but didn't report its status for %v",
+					addr, silent.Round(time.Second)))
+			}
+		}
+		metrics.lock.Unlock()
+	}
+	return connected, len(addrs), err
+}
+
+// Writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	out io.Writer
+}
+
+func (writer metricsWriter) header(name string, kind string, help string) {
+	_, _ = fmt.Fprintf(writer.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (writer metricsWriter) sample(name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	_, _ = fmt.Fprintf(writer.out, "%s%s %g\n", name, labels, value)
+}
+
+func (writer metricsWriter) metric(name string, kind string, help string, value float64) {
+	writer.header(name, kind, help)
+	writer.sample(name, "", value)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Copy of a device's metrics, so they can be written without holding its lock
+type deviceSnapshot struct {
+	labels string
+	deviceMetrics
+}
+
+func (registry *metricsRegistry) WriteMetrics(out io.Writer) {
+	writer := metricsWriter{out: out}
+
+	registry.lock.Lock()
+	client := registry.mqtt
+	addrs := make([]string, 0, len(registry.devices))
+	for addr := range registry.devices {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	devices := make([]deviceSnapshot, 0, len(addrs))
+	for _, addr := range addrs {
+		metrics := registry.devices[addr]
+		metrics.lock.Lock()
+		snapshot := deviceSnapshot{labels: fmt.Sprintf(`address="%s"`, escapeLabelValue(addr)), deviceMetrics: *metrics}
+		snapshot.writeLatency.counts = append([]uint64(nil), metrics.writeLatency.counts...)
+		metrics.lock.Unlock()
+		devices = append(devices, snapshot)
+	}
+	registry.lock.Unlock()
+
+	if client != nil {
+		writer.metric("consmart_mqtt_connected", "gauge", "Whether the bridge is connected to the MQTT broker",
+			boolToFloat(client.IsConnected()))
+		writer.metric("consmart_mqtt_connection_lost_total", "counter", "Times the connection to the broker was lost",
+			float64(client.ConnectionLostCount()))
+	}
+	writer.metric("consmart_mqtt_messages_received_total", "counter", "MQTT messages received",
+		float64(atomic.LoadUint64(registry.mqttReceived)))
+	writer.metric("consmart_mqtt_messages_published_total", "counter", "MQTT messages published",
+		float64(atomic.LoadUint64(registry.mqttPublished)))
+	writer.metric("consmart_bluetooth_io_errors_total", "counter", "Input/output errors from the Bluetooth adapter",
+		float64(atomic.LoadUint64(registry.bluetoothIOErrors)))
+	writer.metric("consmart_bluetooth_reset_requests_total", "counter", "Times a Bluetooth adapter reset was requested",
+		float64(atomic.LoadUint64(registry.bluetoothResetRequests)))
+
+	writer.header("consmart_device_info", "gauge", "Mountpoint of the light, always 1")
+	for _, device := range devices {
+		writer.sample("consmart_device_info",
+			fmt.Sprintf(`%s,mountpoint="%s"`, device.labels, escapeLabelValue(device.mountpoint)), 1)
+	}
+	writer.header("consmart_device_connected", "gauge", "Whether the light is connected")
+	for _, device := range devices {
+		writer.sample("consmart_device_connected", device.labels, boolToFloat(device.connected))
+	}
+	writer.header("consmart_device_reconnects_total", "counter", "Times the light was connected again after the first time")
+	for _, device := range devices {
+		reconnects := uint64(0)
+		if device.connections > 1 {
+			reconnects = device.connections - 1
+		}
+		writer.sample("consmart_device_reconnects_total", device.labels, float64(reconnects))
+	}
+	writer.header("consmart_device_seconds_since_last_status", "gauge", "Seconds since the last status frame from the light")
+	for _, device := range devices {
+		if !device.lastStatus.IsZero() {
+			writer.sample("consmart_device_seconds_since_last_status", device.labels, time.Since(device.lastStatus).Seconds())
+		}
+	}
+	writer.header("consmart_device_write_duration_seconds", "histogram", "Time taken by GATT writes to the light")
+	for _, device := range devices {
+		for i, bound := range device.writeLatency.buckets {
+			writer.sample("consmart_device_write_duration_seconds_bucket",
+				fmt.Sprintf(`%s,le="%g"`, device.labels, bound), float64(device.writeLatency.counts[i]))
+		}
+		writer.sample("consmart_device_write_duration_seconds_bucket",
+			device.labels+`,le="+Inf"`, float64(device.writeLatency.count))
+		writer.sample("consmart_device_write_duration_seconds_sum", device.labels, device.writeLatency.sum)
+		writer.sample("consmart_device_write_duration_seconds_count", device.labels, float64(device.writeLatency.count))
+	}
+	writer.header("consmart_device_write_errors_total", "counter", "GATT writes to the light that failed")
+	for _, device := range devices {
+		writer.sample("consmart_device_write_errors_total", device.labels, float64(device.writeErrors))
+	}
+	writer.header("consmart_device_bad_frames_total", "counter", "Notifications from the light that could not be decoded")
+	for _, device := range devices {
+		writer.sample("consmart_device_bad_frames_total", device.labels, float64(device.badFrames))
+	}
+	writer.header("consmart_device_power", "gauge", "Last known power state of the light")
+	for _, device := range devices {
+		if !device.lastStatus.IsZero() {
+			writer.sample("consmart_device_power", device.labels, boolToFloat(device.status.Power))
+		}
+	}
+	writer.header("consmart_device_color", "gauge", "Last known value of each channel of the light")
+	for _, device := range devices {
+		if device.lastStatus.IsZero() {
+			continue
+		}
+		channels := []struct {
+			name  string
+			value uint8
+		}{
+			{"red", device.status.R},
+			{"green", device.status.G},
+			{"blue", device.status.B},
+			{"white", device.status.WarmWhiteIntensity},
+		}
+		for _, channel := range channels {
+			writer.sample("consmart_device_color",
+				fmt.Sprintf(`%s,channel="%s"`, device.labels, channel.name), float64(channel.value))
+		}
+	}
+}
+
+func (registry *metricsRegistry) ServeHTTP(response http.ResponseWriter, _ *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteMetrics(response)
+}
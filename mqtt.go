@@ -1,119 +1,145 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/Depau/consmart-ble-mqtt/triones"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"path"
 	"strconv"
-	"strings"
 )
 
-func GetMessageHandlerSetColor(bleLight *BleLight) (handler func(client mqtt.Client, message mqtt.Message)) {
+// Returns a handler that parses commands with the given function and applies them to the light
+func getMessageHandler(
+	controller *lightController,
+	log *fieldLogger,
+	kind string,
+	parse func(payload []byte) (*LightCommand, error),
+) (handler func(client mqtt.Client, message mqtt.Message)) {
 	return func(client mqtt.Client, message mqtt.Message) {
-		colorValue := string(message.Payload()[:])
-		color, err := numberStringToUInt8Slice(colorValue)
+		command, err := parse(message.Payload())
 		if err != nil {
-			log.Errorf("unable to parse color, '%s': %v", colorValue, err)
+			log.Errorf("unable to parse %s command '%s': %v", kind, message.Payload(), err)
 			return
 		}
-		if len(color) != 3 {
-			log.Errorf("invalid color length: %d", len(color))
-			return
-		}
-		r := color[0]
-		g := color[1]
-		b := color[2]
-
-		// Simulate simple power control to be nice to Google Assistant
-		if r == g && g == b && b == r && r == 0 {
-			if err := (*bleLight).SetPower(false); err != nil {
-				log.Error("unable to turn off light: ", err)
-			}
-			return
-		} else {
-			if err := (*bleLight).SetPower(true); err != nil {
-				log.Error("unable to turn on light: ", err)
-				// ignore error, light might be already on so we can as well try to set the other values
-			}
+		if err := controller.Apply(command); err != nil {
+			log.Errorf("unable to apply %s command: %v", kind, err)
 		}
+	}
+}
 
-		// Simulate simple white control
-		if r == g && g == b && b == r {
-			if err := (*bleLight).SetWarmWhite(r); err != nil {
-				log.Error("unable to set white intensity: ", err)
-			}
-			return
-		}
+func GetMessageHandlerSetColor(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "color", ParseColorCommand)
+}
 
-		if err := (*bleLight).SetRGB(r, g, b); err != nil {
-			log.Error("unable to set RGB color: ", err)
-			return
-		}
-	}
+func GetMessageHandlerSetHSV(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "HSV", ParseHSVCommand)
 }
 
-func GetMessageHandlerSetMode(bleLight *BleLight) (handler func(client mqtt.Client, message mqtt.Message)) {
-	return func(client mqtt.Client, message mqtt.Message) {
-		str := string(message.Payload()[:])
-		splitStr := strings.Split(str, ",")
-		if len(splitStr) != 2 {
-			log.Errorf("invalid number of separators in mode string '%s': %d", str, len(splitStr))
-			return
-		}
+func GetMessageHandlerSetBrightness(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "brightness", ParseBrightnessCommand)
+}
 
-		mode := splitStr[0]
-		speed, err := strconv.ParseUint(splitStr[1], 10, 8)
-		if err != nil {
-			log.Errorf("unable to parse mode speed '%s': %v", str, err)
-			return
-		}
+func GetMessageHandlerSetColorTemp(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "color temperature", ParseColorTempCommand)
+}
 
-		if err := (*bleLight).SetMode(mode, uint8(speed)); err != nil {
-			log.Error("unable to set mode: ", err)
-			return
-		}
-	}
+func GetMessageHandlerSetMode(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "mode", ParseModeCommand)
 }
 
-func GetMessageHandlerSetPower(bleLight *BleLight) (handler func(client mqtt.Client, message mqtt.Message)) {
-	return func(client mqtt.Client, message mqtt.Message) {
-		str := string(message.Payload()[:])
+func GetMessageHandlerSetPower(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "power", ParsePowerCommand)
+}
 
-		if str != "off" && str != "on" {
-			log.Error("invalid power control string: ", str)
-		}
+func GetMessageHandlerSetJSON(controller *lightController, log *fieldLogger) (handler func(client mqtt.Client, message mqtt.Message)) {
+	return getMessageHandler(controller, log, "JSON", ParseJSONCommand)
+}
 
-		if err := (*bleLight).SetPower(str == "on"); err != nil {
-			log.Error("unable to set light power: ", err)
+// State published to the state topic. It's in the same format as the commands, plus the fields Home Assistant's JSON
+// schema needs.
+type jsonState struct {
+	State      string    `json:"state"`
+	ColorMode  string    `json:"color_mode"`
+	Color      jsonColor `json:"color"`
+	White      *uint8    `json:"white,omitempty"`
+	Brightness *uint8    `json:"brightness,omitempty"`
+	ColorTemp  *uint16   `json:"color_temp,omitempty"`
+	Effect     *string   `json:"effect"`
+	Speed      *uint8    `json:"speed,omitempty"`
+}
+
+// Returns the state of a light in the given status. RGB colors that show a color temperature are reported as such,
+// unless temps is nil.
+func makeJSONState(status *LightStatus, temps *colorTempSettings) jsonState {
+	state := jsonState{
+		State:     "OFF",
+		ColorMode: "rgb",
+		Color:     jsonColor{R: status.R, G: status.G, B: status.B},
+	}
+	if status.Power {
+		state.State = "ON"
+	}
+	if status.Mode != "control" {
+		effect := status.Mode
+		speed := status.Speed
+		state.Effect = &effect
+		state.Speed = &speed
+	} else if status.WarmWhite {
+		white := status.WarmWhiteIntensity
+		state.ColorMode = "white"
+		state.White = &white
+		state.Brightness = &white
+	} else {
+		brightness := colorBrightness(state.Color)
+		state.Brightness = &brightness
+		if temps == nil {
+			return state
+		}
+		if kelvin, ok := temps.rgbToKelvin(state.Color); ok {
+			colorTemp := kelvinToMireds(kelvin)
+			state.ColorMode = "color_temp"
+			state.ColorTemp = &colorTemp
 		}
 	}
+	return state
+}
+
+// Published to the debug/bad_frame topic for each notification that couldn't be decoded
+type badFrameReport struct {
+	Error string `json:"error"`
+	Hex   string `json:"hex"`
 }
 
 func StatusChanPublisher(
+	ctx context.Context,
 	mountpoint string,
 	client *mqtt.Client,
 	statusChan <-chan LightStatus,
-	stopRope StopRope,
-) {
-	if err := stopRope.Hold(); err != nil {
-		return
-	}
-	defer stopRope.Release()
-
+	frameErrorChan <-chan *triones.FrameError,
+	metrics *deviceMetrics,
+	temps *colorTempSettings,
+) error {
 	var lastUpdate *map[string]string = nil
 
 	modeTopic := path.Join(mountpoint, "status/mode")
 	rgbTopic := path.Join(mountpoint, "status/color")
 	powerTopic := path.Join(mountpoint, "status/power")
+	brightnessTopic := path.Join(mountpoint, "status/brightness")
+	hsTopic := path.Join(mountpoint, "status/hs")
+	colorTempTopic := path.Join(mountpoint, "status/color_temp")
+	stateTopic := path.Join(mountpoint, "state")
+	badFrameTopic := path.Join(mountpoint, "debug/bad_frame")
 
-Loop:
 	for {
 		select {
 		case status, ok := <-statusChan:
 			if !ok {
-				break Loop
+				return nil
 			}
+			metrics.StatusReceived(&status)
 
 			update := make(map[string]string)
 
@@ -129,11 +155,37 @@ Loop:
 			}
 			update[modeTopic] = mode
 			update[rgbTopic] = getColorString(status.R, status.G, status.B)
+			// Built-in modes change the color on their own
+			if status.Mode == "control" {
+				if status.WarmWhite {
+					update[brightnessTopic] = strconv.Itoa(int(status.WarmWhiteIntensity))
+					update[hsTopic] = "0,0"
+				} else {
+					color := jsonColor{R: status.R, G: status.G, B: status.B}
+					hue, saturation, _ := rgbToHsv(color)
+					update[brightnessTopic] = strconv.Itoa(int(colorBrightness(color)))
+					update[hsTopic] = fmt.Sprintf("%.0f,%.0f", hue, saturation*100)
+				}
+			}
+			if kelvin, ok := temps.statusKelvin(&status); ok {
+				update[colorTempTopic] = strconv.Itoa(kelvin)
+			}
+			// Cleared when they don't apply, so the retained ones don't outlive the control mode
+			for _, topic := range []string{brightnessTopic, hsTopic, colorTempTopic} {
+				if _, ok := update[topic]; !ok {
+					update[topic] = ""
+				}
+			}
 			if status.Power {
 				update[powerTopic] = "on"
 			} else {
 				update[powerTopic] = "off"
 			}
+			if state, err := json.Marshal(makeJSONState(&status, temps)); err != nil {
+				mqttLog.Error("unable to serialize JSON state: ", err)
+			} else {
+				update[stateTopic] = string(state)
+			}
 
 			// Publish only changed values
 			for topic, payload := range update {
@@ -149,14 +201,46 @@ Loop:
 
 			break
 
-		case <-stopRope.WaitCut():
-			break Loop
+		case frameErr := <-frameErrorChan:
+			payload, err := json.Marshal(badFrameReport{
+				Error: frameErr.Err.Error(),
+				Hex:   hex.EncodeToString(frameErr.Frame),
+			})
+			if err != nil {
+				mqttLog.Error("unable to serialize bad frame report: ", err)
+				break
+			}
+			(*client).Publish(badFrameTopic, 0, false, payload)
+
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
-func ConnectClient(config *MQTTConfig) (client mqtt.Client, err error) {
-	onlineTopic := path.Join(*(config.MountPoint), "online")
+// Retained topics published under a device's mountpoint
+var deviceRetainedTopics = []string{"connected", "state", "status/mode", "status/color", "status/power",
+	"status/brightness", "status/hs", "status/color_temp"}
+
+// Deletes the retained messages of a device that is not served at this mountpoint anymore
+func ClearDeviceTopics(client mqtt.Client, devMountpoint string) {
+	for _, topic := range deviceRetainedTopics {
+		client.Publish(path.Join(devMountpoint, topic), 1, true, "")
+	}
+}
+
+func getMountpoint(config *MQTTConfig) string {
+	if config.MountPoint != nil {
+		return *config.MountPoint
+	}
+	return "/"
+}
+
+func (client *bridgeClient) makeClientOptions(
+	config *MQTTConfig,
+	onlineTopic string,
+) (*mqtt.ClientOptions, clientSettings, error) {
+	settings := clientSettings{config: *config}
 
 	clientOptions := mqtt.NewClientOptions()
 	for _, broker := range config.Servers {
@@ -164,29 +248,49 @@ func ConnectClient(config *MQTTConfig) (client mqtt.Client, err error) {
 	}
 	clientOptions.SetAutoReconnect(true)
 	clientOptions.SetWill(onlineTopic, "false", 1, true)
+	clientOptions.SetOnConnectHandler(client.onConnect)
+	clientOptions.SetConnectionLostHandler(client.onConnectionLost)
 
 	if config.ClientID != nil {
 		clientOptions.SetClientID(*config.ClientID)
 	}
-	if config.Username != nil {
-		clientOptions.SetUsername(*config.Username)
+
+	username, password, err := getCredentials(config)
+	if err != nil {
+		return nil, settings, err
+	}
+	settings.username = username
+	settings.password = password
+	if username != nil {
+		clientOptions.SetUsername(*username)
 	}
-	if config.Password != nil {
-		clientOptions.SetPassword(*config.Password)
+	if password != nil {
+		clientOptions.SetPassword(*password)
 	}
+
 	if config.TLS != nil {
-		clientOptions.SetTLSConfig(&tls.Config{
-			InsecureSkipVerify: config.TLS.InsecureSkipVerify,
-		})
+		tlsConfig, err := NewTLSConfig(config.TLS)
+		if err != nil {
+			return nil, settings, err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
 	}
+	return clientOptions, settings, nil
+}
+
+func ConnectClient(config *MQTTConfig) (client *bridgeClient, err error) {
+	client = newBridgeClient(getMountpoint(config))
 
-	client = mqtt.NewClient(clientOptions)
+	clientOptions, settings, err := client.makeClientOptions(config, client.onlineTopic)
+	if err != nil {
+		return nil, err
+	}
+	client.client = mqtt.NewClient(clientOptions)
+	client.settings = settings
 
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		err = token.Error()
 	}
 
-	client.Publish(onlineTopic, 1, true, "true")
-
 	return
 }
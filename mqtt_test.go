@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"github.com/Depau/consmart-ble-mqtt/triones"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+)
+
+type publishedMessage struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// Client that hands what is published over to the test. Anything else panics.
+type publishingClient struct {
+	mqtt.Client
+	published chan publishedMessage
+}
+
+func (client *publishingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	client.published <- publishedMessage{topic: topic, retained: retained, payload: payload.(string)}
+	return &mqtt.DummyToken{}
+}
+
+func TestPublisherClearsControlTopics(t *testing.T) {
+	publishing := &publishingClient{published: make(chan publishedMessage, 64)}
+	var client mqtt.Client = publishing
+	statusChan := make(chan LightStatus)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan interface{})
+	go func() {
+		defer close(done)
+		_ = StatusChanPublisher(ctx, "light", &client, statusChan, make(chan *triones.FrameError), nil,
+			getColorTempSettings(&DeviceConfig{}))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Returns the retained payloads published for a status
+	publish := func(status LightStatus) map[string]string {
+		statusChan <- status
+		// The next status is only taken once this one is published
+		statusChan <- status
+		published := make(map[string]string)
+		for {
+			select {
+			case message := <-publishing.published:
+				if !message.retained {
+					t.Errorf("%s published without retain", message.topic)
+				}
+				published[message.topic] = message.payload
+			default:
+				return published
+			}
+		}
+	}
+
+	published := publish(LightStatus{Power: true, Mode: "control", R: 255, G: 0, B: 0})
+	if published["light/status/brightness"] != "255" || published["light/status/hs"] != "0,100" {
+		t.Fatalf("published %v, want brightness and hue of red", published)
+	}
+
+	published = publish(LightStatus{Power: true, Mode: "smooth rainbow", Speed: 10, R: 12, G: 34, B: 56})
+	for _, topic := range []string{"light/status/brightness", "light/status/hs"} {
+		if payload, ok := published[topic]; !ok {
+			t.Errorf("%s not cleared", topic)
+		} else if payload != "" {
+			t.Errorf("%s = %q, want it cleared", topic, payload)
+		}
+	}
+
+	// Cleared only once
+	published = publish(LightStatus{Power: true, Mode: "smooth rainbow", Speed: 10, R: 56, G: 34, B: 12})
+	for _, topic := range []string{"light/status/brightness", "light/status/hs"} {
+		if payload, ok := published[topic]; ok {
+			t.Errorf("%s published again as %q", topic, payload)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// What the connection was established with, credentials included since they may come from outside the config
+type clientSettings struct {
+	config   MQTTConfig
+	username *string
+	password *string
+}
+
+type retainedMessage struct {
+	qos     byte
+	payload interface{}
+}
+
+// Published to bridge/connection_lost once the connection to the broker is back
+type connectionLostEvent struct {
+	Error      string    `json:"error"`
+	LostAt     time.Time `json:"lost_at"`
+	RestoredAt time.Time `json:"restored_at"`
+	Count      uint64    `json:"count"`
+}
+
+// MQTT client that keeps track of the active subscriptions and of the last retained message published to each topic.
+//
+// Paho reconnects automatically, but with a clean session the broker forgets about our subscriptions, and while we're
+// gone the will message marks us offline. Every time the connection is (re-)established the subscriptions are replayed
+// and the retained messages, which include the online state, the connected state and the last known status of every
+// light, are published again.
+//
+// The same goes when the underlying paho client is replaced by Reconfigure(), so the rest of the bridge can keep
+// using the same bridgeClient while the connection settings change.
+type bridgeClient struct {
+	lock                *sync.Mutex
+	client              mqtt.Client
+	onlineTopic         string
+	connectionLostTopic string
+	logTopic            string
+	subscriptions       map[string]subscription
+	retained            map[string]retainedMessage
+	connectionLostCount *uint64
+	lastConnectionLost  *connectionLostEvent
+	settings            clientSettings
+}
+
+func newBridgeClient(mountpoint string) *bridgeClient {
+	return &bridgeClient{
+		lock:                &sync.Mutex{},
+		onlineTopic:         path.Join(mountpoint, "online"),
+		connectionLostTopic: path.Join(mountpoint, "bridge/connection_lost"),
+		logTopic:            path.Join(mountpoint, "bridge/log"),
+		subscriptions:       make(map[string]subscription),
+		retained:            make(map[string]retainedMessage),
+		connectionLostCount: new(uint64),
+	}
+}
+
+func (client *bridgeClient) current() mqtt.Client {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.client
+}
+
+func (client *bridgeClient) IsConnected() bool {
+	return client.current().IsConnected()
+}
+
+func (client *bridgeClient) IsConnectionOpen() bool {
+	return client.current().IsConnectionOpen()
+}
+
+func (client *bridgeClient) Connect() mqtt.Token {
+	return client.current().Connect()
+}
+
+func (client *bridgeClient) Disconnect(quiesce uint) {
+	client.current().Disconnect(quiesce)
+}
+
+func (client *bridgeClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	client.current().AddRoute(topic, callback)
+}
+
+func (client *bridgeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return client.current().OptionsReader()
+}
+
+func (client *bridgeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	bridgeMetrics.MQTTMessagePublished()
+	client.lock.Lock()
+	if retained {
+		if isEmptyPayload(payload) {
+			delete(client.retained, topic)
+		} else {
+			client.retained[topic] = retainedMessage{qos: qos, payload: payload}
+		}
+	}
+	current := client.client
+	client.lock.Unlock()
+	return current.Publish(topic, qos, retained, payload)
+}
+
+// Publishes a log record to bridge/log
+func (client *bridgeClient) PublishLog(payload []byte) mqtt.Token {
+	client.lock.Lock()
+	topic := client.logTopic
+	client.lock.Unlock()
+	return client.Publish(topic, 0, false, payload)
+}
+
+func (client *bridgeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	callback = countingHandler(callback)
+	client.lock.Lock()
+	client.subscriptions[topic] = subscription{qos: qos, handler: callback}
+	current := client.client
+	client.lock.Unlock()
+	return current.Subscribe(topic, qos, callback)
+}
+
+func (client *bridgeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	callback = countingHandler(callback)
+	client.lock.Lock()
+	for topic, qos := range filters {
+		client.subscriptions[topic] = subscription{qos: qos, handler: callback}
+	}
+	current := client.client
+	client.lock.Unlock()
+	return current.SubscribeMultiple(filters, callback)
+}
+
+func (client *bridgeClient) Unsubscribe(topics ...string) mqtt.Token {
+	client.lock.Lock()
+	for _, topic := range topics {
+		delete(client.subscriptions, topic)
+	}
+	current := client.client
+	client.lock.Unlock()
+	return current.Unsubscribe(topics...)
+}
+
+// Replaces the current connection with one using the new settings. Brokers kick out the older of two connections
+// with the same client ID, so the current one is closed first; if the new one can't be established, the old one is
+// connected again.
+func (client *bridgeClient) Reconfigure(config *MQTTConfig) error {
+	mountpoint := getMountpoint(config)
+	onlineTopic := path.Join(mountpoint, "online")
+	options, settings, err := client.makeClientOptions(config, onlineTopic)
+	if err != nil {
+		return err
+	}
+	newClient := mqtt.NewClient(options)
+
+	client.lock.Lock()
+	oldClient := client.client
+	oldSettings := client.settings
+	oldOnlineTopic := client.onlineTopic
+	oldConnectionLostTopic := client.connectionLostTopic
+	oldLogTopic := client.logTopic
+	client.lock.Unlock()
+
+	if oldOnlineTopic != onlineTopic {
+		// Nothing's there anymore
+		oldClient.Publish(oldOnlineTopic, 1, true, "").Wait()
+	}
+	oldClient.Disconnect(250)
+
+	// Swap before connecting, so onConnect restores everything on the new client
+	client.lock.Lock()
+	client.client = newClient
+	client.settings = settings
+	client.onlineTopic = onlineTopic
+	client.connectionLostTopic = path.Join(mountpoint, "bridge/connection_lost")
+	client.logTopic = path.Join(mountpoint, "bridge/log")
+	client.lock.Unlock()
+
+	if token := newClient.Connect(); token.Wait() && token.Error() != nil {
+		err = token.Error()
+
+		client.lock.Lock()
+		client.client = oldClient
+		client.settings = oldSettings
+		client.onlineTopic = oldOnlineTopic
+		client.connectionLostTopic = oldConnectionLostTopic
+		client.logTopic = oldLogTopic
+		client.lock.Unlock()
+
+		if token := oldClient.Connect(); token.Wait() && token.Error() != nil {
+			mqttLog.Errorf("unable to reconnect with the previous MQTT settings: %v", token.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// Whether connecting with the given config would make any difference
+func (client *bridgeClient) SettingsChanged(config *MQTTConfig) (bool, error) {
+	username, password, err := getCredentials(config)
+	if err != nil {
+		return false, err
+	}
+	settings := clientSettings{config: *config, username: username, password: password}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return !reflect.DeepEqual(settings, client.settings), nil
+}
+
+// Number of times the connection to the broker was lost
+func (client *bridgeClient) ConnectionLostCount() uint64 {
+	return atomic.LoadUint64(client.connectionLostCount)
+}
+
+func (client *bridgeClient) onConnectionLost(lostClient mqtt.Client, err error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if lostClient != client.client {
+		return
+	}
+
+	count := atomic.AddUint64(client.connectionLostCount, 1)
+	mqttLog.Warningf("connection to MQTT broker lost, reconnecting: %v", err)
+	client.lastConnectionLost = &connectionLostEvent{
+		Error:  err.Error(),
+		LostAt: time.Now(),
+		Count:  count,
+	}
+}
+
+// Called by paho in a new goroutine every time the connection is established
+func (client *bridgeClient) onConnect(connectedClient mqtt.Client) {
+	client.lock.Lock()
+	if connectedClient != client.client {
+		// Replaced by Reconfigure() in the meantime
+		client.lock.Unlock()
+		return
+	}
+	subscriptions := make(map[string]subscription, len(client.subscriptions))
+	for topic, sub := range client.subscriptions {
+		subscriptions[topic] = sub
+	}
+	retained := make(map[string]retainedMessage, len(client.retained))
+	for topic, message := range client.retained {
+		retained[topic] = message
+	}
+	onlineTopic := client.onlineTopic
+	connectionLostTopic := client.connectionLostTopic
+	lost := client.lastConnectionLost
+	client.lastConnectionLost = nil
+	client.lock.Unlock()
+
+	if lost != nil {
+		mqttLog.Infof("connection to MQTT broker restored, restoring %d subscriptions", len(subscriptions))
+	}
+
+	connectedClient.Publish(onlineTopic, 1, true, "true")
+
+	for topic, sub := range subscriptions {
+		if token := connectedClient.Subscribe(topic, sub.qos, sub.handler); token.Wait() && token.Error() != nil {
+			mqttLog.Errorf("unable to restore subscription to '%s': %v", topic, token.Error())
+		}
+	}
+	for topic, message := range retained {
+		connectedClient.Publish(topic, message.qos, true, message.payload)
+	}
+
+	if lost != nil {
+		lost.RestoredAt = time.Now()
+		if payload, err := json.Marshal(lost); err == nil {
+			connectedClient.Publish(connectionLostTopic, 1, false, payload)
+		}
+	}
+}
+
+// Counts the messages received before handling them
+func countingHandler(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		bridgeMetrics.MQTTMessageReceived()
+		handler(client, message)
+	}
+}
+
+func isEmptyPayload(payload interface{}) bool {
+	switch payload := payload.(type) {
+	case string:
+		return payload == ""
+	case []byte:
+		return len(payload) == 0
+	}
+	return payload == nil
+}
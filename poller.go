@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Default status polling interval while the light is static
+	defaultReadStatusInterval = 10 * time.Second
+	// Default status polling interval while a built-in mode is running, so color changes are reported
+	defaultReadStatusIntervalAnimated = 1 * time.Second
+	// Delay between a command and the status request that follows it, to give the light time to apply it
+	commandStatusDelay = 300 * time.Millisecond
+	// A connected light that misses this many status requests in a row is considered stuck...
+	stuckStatusIntervals = 3
+	// ...as long as it has been silent for at least this long
+	minStuckStatusTimeout = 1 * time.Minute
+)
+
+// Requests status updates from the light and relays the decoded ones to the publisher.
+//
+// Polling is adaptive: the light is polled often while a built-in mode is running, rarely when it is static and once
+// right after each command, since that's when the status is likely to have changed.
+type statusPoller struct {
+	light              BleLight
+	staticInterval     time.Duration
+	animatedInterval   time.Duration
+	kickChan           chan interface{}
+	statusIn           <-chan LightStatus
+	statusOut          chan<- LightStatus
+	bluetoothResetChan chan<- bool
+}
+
+func getStatusIntervals(deviceConfig *DeviceConfig) (static time.Duration, animated time.Duration) {
+	static = defaultReadStatusInterval
+	animated = defaultReadStatusIntervalAnimated
+	if deviceConfig.ReadStatusInterval != nil && *deviceConfig.ReadStatusInterval > 0 {
+		static = time.Duration(*deviceConfig.ReadStatusInterval * float64(time.Second))
+	}
+	if deviceConfig.ReadStatusIntervalAnimated != nil && *deviceConfig.ReadStatusIntervalAnimated > 0 {
+		animated = time.Duration(*deviceConfig.ReadStatusIntervalAnimated * float64(time.Second))
+	}
+	return
+}
+
+// How long a connected light can go without reporting its status before it's considered stuck
+func getStatusTimeout(deviceConfig *DeviceConfig) time.Duration {
+	static, _ := getStatusIntervals(deviceConfig)
+	if timeout := stuckStatusIntervals * static; timeout > minStuckStatusTimeout {
+		return timeout
+	}
+	return minStuckStatusTimeout
+}
+
+func newStatusPoller(
+	light BleLight,
+	deviceConfig *DeviceConfig,
+	statusIn <-chan LightStatus,
+	statusOut chan<- LightStatus,
+	bluetoothResetChan chan<- bool,
+) *statusPoller {
+	static, animated := getStatusIntervals(deviceConfig)
+	return &statusPoller{
+		light:              light,
+		staticInterval:     static,
+		animatedInterval:   animated,
+		kickChan:           make(chan interface{}, 1),
+		statusIn:           statusIn,
+		statusOut:          statusOut,
+		bluetoothResetChan: bluetoothResetChan,
+	}
+}
+
+// Kick schedules a status request shortly after a command has been sent. It never blocks.
+func (poller *statusPoller) Kick() {
+	select {
+	case poller.kickChan <- nil:
+	default:
+	}
+}
+
+// Polls the light until ctx is cancelled. Fails if a status request can't be sent, since that means the light is gone.
+func (poller *statusPoller) Run(ctx context.Context) error {
+	interval := poller.staticInterval
+	// Ask for the status right away, so it's published as soon as the light is connected
+	deadline := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// Moves the next request earlier, never later
+	pollWithin := func(delay time.Duration) {
+		if next := time.Now().Add(delay); next.Before(deadline) {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			deadline = next
+			timer.Reset(delay)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-poller.kickChan:
+			pollWithin(commandStatusDelay)
+
+		case status := <-poller.statusIn:
+			if status.Mode != "control" {
+				interval = poller.animatedInterval
+			} else {
+				interval = poller.staticInterval
+			}
+			pollWithin(interval)
+
+			select {
+			case poller.statusOut <- status:
+			case <-ctx.Done():
+				return nil
+			}
+
+		case <-timer.C:
+			if err := poller.light.RequestLightStatus(); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if isIOError(err) {
+					bridgeMetrics.BluetoothIOError()
+					requestBluetoothReset(poller.bluetoothResetChan)
+					return errors.New(fmt.Sprintf("failed to request light status, bluetooth needs reset: %v", err))
+				}
+				return errors.New(fmt.Sprintf("failed to request light status: %v", err))
+			}
+			deadline = time.Now().Add(interval)
+			timer.Reset(interval)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus"
+	device2 "github.com/muka/go-bluetooth/bluez/profile/device"
+	"github.com/muka/go-bluetooth/bluez/profile/gatt"
+	"strings"
+	"sync"
+)
+
+// GATT layout used by a family of Triones lights: the services holding the write and notify characteristics, and
+// the UUIDs these characteristics usually have
+type gattLayout struct {
+	name          string
+	writeService  string
+	writeChar     string
+	notifyService string
+	notifyChar    string
+}
+
+// Known layouts, in order of preference
+var knownGattLayouts = []gattLayout{
+	{"Triones", shortUUID(0xffd5), RGBCharUUID, shortUUID(0xffd0), NotifyCharUUID},
+	{"Triones (ffe5/ffe0)", shortUUID(0xffe5), shortUUID(0xffe9), shortUUID(0xffe0), shortUUID(0xffe4)},
+	{"HappyLighting (ffe0)", shortUUID(0xffe0), shortUUID(0xffe1), shortUUID(0xffe0), shortUUID(0xffe1)},
+}
+
+var (
+	writeFlags  = []string{"write-without-response", "write"}
+	notifyFlags = []string{"notify", "indicate"}
+)
+
+// Expands a 16-bit UUID with the Bluetooth base UUID
+func shortUUID(uuid uint16) string {
+	return fmt.Sprintf("0000%04x-0000-1000-8000-00805f9b34fb", uuid)
+}
+
+// Characteristic found by probing a device. The UUIDs are not unique on all lights, so it's remembered by its object
+// path, along with the one of its service.
+type probedCharacteristic struct {
+	uuid    string
+	service dbus.ObjectPath
+	path    dbus.ObjectPath
+}
+
+func makeProbedCharacteristic(char *gatt.GattCharacteristic1) probedCharacteristic {
+	return probedCharacteristic{
+		uuid:    strings.ToLower(char.Properties.UUID),
+		service: char.Properties.Service,
+		path:    char.Path(),
+	}
+}
+
+// Opens the characteristic, if it's still where it was found
+func (probed probedCharacteristic) open() (*gatt.GattCharacteristic1, error) {
+	char, err := gatt.NewGattCharacteristic1(probed.path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("characteristic '%s' is gone: %v", probed.path, err))
+	}
+	if !strings.EqualFold(char.Properties.UUID, probed.uuid) || char.Properties.Service != probed.service {
+		char.Close()
+		return nil, errors.New(fmt.Sprintf("characteristic '%s' is not %s anymore", probed.path, probed.uuid))
+	}
+	return char, nil
+}
+
+type probedCharacteristics struct {
+	layout string
+	write  probedCharacteristic
+	notify probedCharacteristic
+}
+
+// Characteristics found by probing devices, by address, remembered so a device doesn't have to be probed every time it
+// reconnects
+type characteristicsCache struct {
+	lock   *sync.Mutex
+	probed map[string]*probedCharacteristics
+}
+
+func newCharacteristicsCache() *characteristicsCache {
+	return &characteristicsCache{
+		lock:   &sync.Mutex{},
+		probed: make(map[string]*probedCharacteristics),
+	}
+}
+
+func (cache *characteristicsCache) Get(addr string) *probedCharacteristics {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.probed[strings.ToUpper(addr)]
+}
+
+func (cache *characteristicsCache) Set(addr string, probed *probedCharacteristics) {
+	cache.lock.Lock()
+	cache.probed[strings.ToUpper(addr)] = probed
+	cache.lock.Unlock()
+}
+
+func hasAnyFlag(char *gatt.GattCharacteristic1, flags []string) bool {
+	for _, charFlag := range char.Properties.Flags {
+		for _, flag := range flags {
+			if charFlag == flag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Picks the characteristic of the service that has one of the flags, preferring the one with the given UUID
+func pickCharacteristic(chars []*gatt.GattCharacteristic1, preferredUUID string, flags []string) *gatt.GattCharacteristic1 {
+	var picked *gatt.GattCharacteristic1
+	for _, char := range chars {
+		if !hasAnyFlag(char, flags) {
+			continue
+		}
+		if strings.EqualFold(char.Properties.UUID, preferredUUID) {
+			return char
+		}
+		if picked == nil {
+			picked = char
+		}
+	}
+	return picked
+}
+
+// Walks the GATT table of a connected device, with its services resolved, and matches it against the known layouts.
+// Returns the first layout whose services are there and have a characteristic that can be written to and one that
+// sends notifications.
+func probeCharacteristics(device *device2.Device1) (*probedCharacteristics, error) {
+	chars, err := device.GetCharacteristics()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to retrieve characteristics: %v", err))
+	}
+	// Only their paths are kept, the ones that are used are opened again by openProbedCharacteristics
+	defer func() {
+		for _, char := range chars {
+			char.Close()
+		}
+	}()
+
+	serviceUUIDs := make(map[dbus.ObjectPath]string)
+	byService := make(map[string][]*gatt.GattCharacteristic1)
+	for _, char := range chars {
+		servicePath := char.Properties.Service
+		serviceUUID, ok := serviceUUIDs[servicePath]
+		if !ok {
+			service, err := gatt.NewGattService1(servicePath)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("unable to retrieve service '%s': %v", servicePath, err))
+			}
+			serviceUUID = strings.ToLower(service.Properties.UUID)
+			service.Close()
+			serviceUUIDs[servicePath] = serviceUUID
+		}
+		byService[serviceUUID] = append(byService[serviceUUID], char)
+	}
+
+	for _, layout := range knownGattLayouts {
+		writeChar := pickCharacteristic(byService[layout.writeService], layout.writeChar, writeFlags)
+		notifyChar := pickCharacteristic(byService[layout.notifyService], layout.notifyChar, notifyFlags)
+		if writeChar == nil || notifyChar == nil {
+			continue
+		}
+		return &probedCharacteristics{
+			layout: layout.name,
+			write:  makeProbedCharacteristic(writeChar),
+			notify: makeProbedCharacteristic(notifyChar),
+		}, nil
+	}
+	return nil, errors.New("no known characteristics layout found")
+}
+
+// Returns the write and notify characteristics of a connected device. The ones in the config are used if they're
+// set; otherwise the device is probed, unless it was probed already and the characteristics found back then are
+// still there.
+func resolveCharacteristics(
+	device *device2.Device1,
+	addr string,
+	deviceConfig *DeviceConfig,
+	cache *characteristicsCache,
+) (writeChar *gatt.GattCharacteristic1, notifyChar *gatt.GattCharacteristic1, err error) {
+	if deviceConfig.RGBCharacteristic != nil && deviceConfig.NotifyCharacteristic != nil {
+		return findConfiguredCharacteristics(device, addr, *deviceConfig.RGBCharacteristic, *deviceConfig.NotifyCharacteristic)
+	}
+
+	probed := cache.Get(addr)
+	if probed != nil && probedMatchesConfig(probed, deviceConfig) {
+		writeChar, notifyChar, err = openProbedCharacteristics(probed)
+		if err == nil {
+			return
+		}
+		withFields(bleLog, "address", addr).Warningf("characteristics found earlier are gone, probing again: %v", err)
+	}
+
+	probed, err = probeCharacteristics(device)
+	if err != nil {
+		logCharacteristics(device)
+		return nil, nil, errors.New(fmt.Sprintf("unable to detect characteristics of '%s': %v", addr, err))
+	}
+	// Only one of them may be set
+	if deviceConfig.RGBCharacteristic != nil || deviceConfig.NotifyCharacteristic != nil {
+		uuid, name := deviceConfig.RGBCharacteristic, "RGB"
+		configured := &probed.write
+		if uuid == nil {
+			uuid, name = deviceConfig.NotifyCharacteristic, "notifications"
+			configured = &probed.notify
+		}
+		char, err := device.GetCharByUUID(*uuid)
+		if err != nil {
+			logCharacteristics(device)
+			return nil, nil, errors.New(fmt.Sprintf("unable to retrieve %s characteristic for '%s': %v", name, addr, err))
+		}
+		*configured = makeProbedCharacteristic(char)
+		char.Close()
+	}
+	withFields(bleLog, "address", addr).Infof("detected %s characteristics: write %s, notify %s",
+		probed.layout, probed.write.uuid, probed.notify.uuid)
+
+	writeChar, notifyChar, err = openProbedCharacteristics(probed)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("unable to open characteristics of '%s': %v", addr, err))
+	}
+	cache.Set(addr, probed)
+	return
+}
+
+// Whether the characteristics are the ones the config asks for, if it asks for one
+func probedMatchesConfig(probed *probedCharacteristics, deviceConfig *DeviceConfig) bool {
+	if deviceConfig.RGBCharacteristic != nil && !strings.EqualFold(*deviceConfig.RGBCharacteristic, probed.write.uuid) {
+		return false
+	}
+	if deviceConfig.NotifyCharacteristic != nil &&
+		!strings.EqualFold(*deviceConfig.NotifyCharacteristic, probed.notify.uuid) {
+		return false
+	}
+	return true
+}
+
+func openProbedCharacteristics(
+	probed *probedCharacteristics,
+) (*gatt.GattCharacteristic1, *gatt.GattCharacteristic1, error) {
+	writeChar, err := probed.write.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	notifyChar, err := probed.notify.open()
+	if err != nil {
+		writeChar.Close()
+		return nil, nil, err
+	}
+	return writeChar, notifyChar, nil
+}
+
+func findConfiguredCharacteristics(
+	device *device2.Device1,
+	addr string,
+	writeUUID string,
+	notifyUUID string,
+) (*gatt.GattCharacteristic1, *gatt.GattCharacteristic1, error) {
+	writeChar, err := device.GetCharByUUID(writeUUID)
+	if err != nil {
+		logCharacteristics(device)
+		return nil, nil, errors.New(fmt.Sprintf("unable to retrieve RGB characteristic for '%s': %v", addr, err))
+	}
+	notifyChar, err := device.GetCharByUUID(notifyUUID)
+	if err != nil {
+		logCharacteristics(device)
+		return nil, nil, errors.New(fmt.Sprintf("unable to retrieve notifications characteristic for '%s': %v", addr, err))
+	}
+	return writeChar, notifyChar, nil
+}
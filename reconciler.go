@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// Times a command the light didn't apply is sent again before giving up
+	maxReconcileRetries = 3
+	// Statuses received this soon after a command may have been requested before it, they're not compared with it
+	reconcileSettleTime = commandStatusDelay
+	// Difference between a channel of the light and the commanded value that is still considered a match
+	colorTolerance = 2
+)
+
+// Published to the event/external_change topic when the light was changed by something else than the bridge
+type externalChangeEvent struct {
+	Desired *LightCommand `json:"desired"`
+	Actual  jsonState     `json:"actual"`
+	// "adopted" or "enforced"
+	Action string `json:"action"`
+}
+
+// Compares the status of a light with the state the bridge wants it in, and acts on the differences.
+//
+// The desired state is made of the commands sent to the light since the bridge connected to it. Until a status
+// confirms the light got there, a different status means the light dropped a command, which is sent again a few
+// times. Once the light got there, a different status means something else, like the phone app or an IR remote,
+// changed the light: the change is published as an event and then either adopted as the new desired state or undone.
+type reconciler struct {
+	addr       string
+	mountpoint string
+	enforce    bool
+	temps      *colorTempSettings
+	client     mqtt.Client
+	log        *fieldLogger
+	statusIn   <-chan LightStatus
+	statusOut  chan<- LightStatus
+
+	lock *sync.Mutex
+	// nil if nothing was commanded, or the bridge gave up on it
+	desired   *LightCommand
+	confirmed bool
+	sentAt    time.Time
+	retries   int
+}
+
+func getEnforceExternalChanges(deviceConfig *DeviceConfig) bool {
+	return deviceConfig.ExternalChanges != nil && *deviceConfig.ExternalChanges == "enforce"
+}
+
+func validateExternalChanges(externalChanges string) error {
+	if externalChanges != "adopt" && externalChanges != "enforce" {
+		return errors.New(fmt.Sprintf("invalid external_changes '%s', must be adopt or enforce", externalChanges))
+	}
+	return nil
+}
+
+func newReconciler(
+	addr string,
+	deviceConfig *DeviceConfig,
+	mountpoint string,
+	client mqtt.Client,
+	log *fieldLogger,
+	statusIn <-chan LightStatus,
+	statusOut chan<- LightStatus,
+) *reconciler {
+	return &reconciler{
+		addr:       addr,
+		mountpoint: mountpoint,
+		enforce:    getEnforceExternalChanges(deviceConfig),
+		temps:      getColorTempSettings(deviceConfig),
+		client:     client,
+		log:        log,
+		statusIn:   statusIn,
+		statusOut:  statusOut,
+		lock:       &sync.Mutex{},
+	}
+}
+
+func channelMatches(actual uint8, desired uint8) bool {
+	return int(actual) >= int(desired)-colorTolerance && int(actual) <= int(desired)+colorTolerance
+}
+
+// Whether the light is in the state the command brings it to
+func statusMatches(status *LightStatus, command *LightCommand, temps *colorTempSettings) bool {
+	if command.State != nil && status.Power != (*command.State == "ON") {
+		return false
+	}
+	// Nothing else can be told while the light is off
+	if !status.Power {
+		return true
+	}
+
+	switch {
+	case command.Effect != nil:
+		speed := defaultModeSpeed
+		if command.Speed != nil {
+			speed = *command.Speed
+		}
+		return status.Mode == *command.Effect && status.Speed == speed
+	case command.ColorTemp != nil:
+		brightness := uint8(255)
+		if command.Brightness != nil {
+			brightness = *command.Brightness
+		}
+		expected, mix := temps.resolve(*command.ColorTemp, brightness)
+		shown := statusColor(status)
+		// A mix shows either half
+		return shown != nil && (mix != nil || shown.near(expected))
+	case command.White != nil:
+		return status.Mode == "control" && status.WarmWhite &&
+			channelMatches(status.WarmWhiteIntensity, *command.White)
+	case command.Color != nil:
+		return status.Mode == "control" && !status.WarmWhite &&
+			channelMatches(status.R, command.Color.R) &&
+			channelMatches(status.G, command.Color.G) &&
+			channelMatches(status.B, command.Color.B)
+	}
+	return true
+}
+
+// Returns the command that brings a light to the given status
+func makeStatusCommand(status *LightStatus) *LightCommand {
+	state := makeJSONState(status, nil)
+	command := &LightCommand{State: &state.State}
+	switch {
+	case state.Effect != nil:
+		command.Effect = state.Effect
+		command.Speed = state.Speed
+	case state.White != nil:
+		command.White = state.White
+	default:
+		command.Color = &state.Color
+	}
+	return command
+}
+
+// Adds a command that is about to be sent to the desired state. Does nothing on a nil *reconciler.
+func (rec *reconciler) Desire(command *LightCommand) {
+	if rec == nil {
+		return
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.desired == nil {
+		rec.desired = &LightCommand{}
+	}
+	rec.desired.Merge(command)
+	rec.confirmed = false
+	// The light only gets there once the transition is over
+	rec.sentAt = time.Now().Add(command.TransitionDuration())
+	rec.retries = 0
+}
+
+// Compares a status with the desired state. Returns the command to send again, if any, and the external change to
+// report, if any.
+func (rec *reconciler) check(status *LightStatus) (resend *LightCommand, event *externalChangeEvent) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.desired == nil || time.Since(rec.sentAt) < reconcileSettleTime {
+		return nil, nil
+	}
+
+	if statusMatches(status, rec.desired, rec.temps) {
+		if !rec.confirmed && rec.retries > 0 {
+			rec.log.Infof("light applied the command on retry %d", rec.retries)
+		}
+		rec.confirmed = true
+		rec.retries = 0
+		return nil, nil
+	}
+
+	if rec.confirmed {
+		desired := *rec.desired
+		event = &externalChangeEvent{Desired: &desired, Actual: makeJSONState(status, rec.temps)}
+		if !rec.enforce {
+			event.Action = "adopted"
+			rec.log.Info("light was changed by something else, adopting the change")
+			// Only the desired state: what is restored stays what the bridge was commanded
+			rec.desired = makeStatusCommand(status)
+			return nil, event
+		}
+		event.Action = "enforced"
+		rec.log.Info("light was changed by something else, undoing the change")
+		rec.confirmed = false
+		rec.retries = 0
+	}
+
+	if rec.retries >= maxReconcileRetries {
+		rec.log.Warningf("light didn't apply the command after %d retries, giving up", rec.retries)
+		rec.desired = nil
+		return nil, event
+	}
+	if event == nil {
+		rec.retries++
+		rec.log.Debugf("light didn't apply the command, sending it again (retry %d)", rec.retries)
+	}
+	rec.sentAt = time.Now()
+	desired := *rec.desired
+	return &desired, event
+}
+
+func (rec *reconciler) publishEvent(event *externalChangeEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		rec.log.Error("unable to serialize external change event: ", err)
+		return
+	}
+	rec.client.Publish(path.Join(rec.mountpoint, "event/external_change"), 1, false, payload)
+}
+
+// Checks the statuses coming from the light on their way to the publisher, until ctx is cancelled
+func (rec *reconciler) Run(ctx context.Context, controller *lightController) error {
+	for {
+		select {
+		case status := <-rec.statusIn:
+			// Checked with the controller locked, so no command is applied but not desired yet meanwhile
+			controller.lock.Lock()
+			controller.StatusReceived(&status)
+			resend, event := rec.check(&status)
+			if resend != nil {
+				if err := controller.apply(resend); err != nil {
+					rec.log.Error("unable to send command again: ", err)
+				}
+			}
+			controller.lock.Unlock()
+			if event != nil {
+				rec.publishEvent(event)
+			}
+
+			select {
+			case rec.statusOut <- status:
+			case <-ctx.Done():
+				return nil
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
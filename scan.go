@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/godbus/dbus"
+	adapter1 "github.com/muka/go-bluetooth/bluez/profile/adapter"
+	device2 "github.com/muka/go-bluetooth/bluez/profile/device"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultScanTimeout = 10 * time.Second
+
+// Lights speaking the Triones protocol advertise themselves with names starting with one of these
+var trionesNamePrefixes = []string{"triones", "flyidea", "ledblue", "ledble"}
+
+// Services the write and notify characteristics belong to, some lights advertise them
+var trionesServiceUUIDs = []string{
+	"0000ffd5-0000-1000-8000-00805f9b34fb",
+	"0000ffd0-0000-1000-8000-00805f9b34fb",
+}
+
+var mountpointUnsafeRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+type scannedLight struct {
+	addr string
+	name string
+	// nil if the light was not seen during the scan, e.g. because it's connected already
+	rssi *int16
+	// Whether the characteristics were checked, and what came out of it
+	checked  bool
+	checkErr error
+	// nil if the characteristics could not be detected
+	probed *probedCharacteristics
+}
+
+// Whether the name or the advertised services of a device look like the ones of a Triones light
+func looksLikeTriones(name string, uuids []string) bool {
+	lowerName := strings.ToLower(name)
+	for _, prefix := range trionesNamePrefixes {
+		if strings.HasPrefix(lowerName, prefix) {
+			return true
+		}
+	}
+	for _, uuid := range uuids {
+		for _, serviceUUID := range trionesServiceUUIDs {
+			if strings.EqualFold(uuid, serviceUUID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Looks for devices for the given time, then returns the ones that look like Triones lights, sorted by address.
+// Lights BlueZ knows about already don't show up as new devices, so they are picked from the ones it knows about,
+// provided they were seen during the scan or they're connected.
+func discoverLights(adapter *adapter1.Adapter1, timeout time.Duration) ([]*scannedLight, error) {
+	scanChan, cancel, err := adapter.OnDeviceDiscovered()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to retrieve discovered devices channel: %v", err))
+	}
+	if err := adapter.StartDiscovery(); err != nil {
+		cancel()
+		return nil, errors.New(fmt.Sprintf("unable to start discovery: %v", err))
+	}
+	log.Infof("scanning for %v...", timeout)
+
+	seen := make(map[dbus.ObjectPath]bool)
+	deadline := time.After(timeout)
+ScanLoop:
+	for {
+		select {
+		case discovered := <-scanChan:
+			if discovered.Type != adapter1.DeviceAdded {
+				continue
+			}
+			seen[discovered.Path] = true
+			if device, err := device2.NewDevice1(discovered.Path); err == nil {
+				addr, _ := device.GetAddress()
+				name, _ := device.GetName()
+				log.Debugf("found device '%s' (%s)", addr, name)
+				device.Close()
+			}
+		case <-deadline:
+			break ScanLoop
+		}
+	}
+	cancel()
+	_ = adapter.StopDiscovery()
+
+	devices, err := adapter.GetDevices()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to retrieve devices: %v", err))
+	}
+
+	var lights []*scannedLight
+	for _, device := range devices {
+		light := &scannedLight{
+			addr: device.Properties.Address,
+			name: device.Properties.Name,
+		}
+		if light.name == "" {
+			light.name = device.Properties.Alias
+		}
+		if rssi, err := device.GetRSSI(); err == nil {
+			light.rssi = &rssi
+		}
+		connected, _ := device.GetConnected()
+		uuids, _ := device.GetUUIDs()
+		device.Close()
+
+		if light.rssi == nil && !connected && !seen[device.Path()] {
+			// Known from an earlier scan, but not around anymore
+			continue
+		}
+		if looksLikeTriones(light.name, uuids) {
+			lights = append(lights, light)
+		}
+	}
+
+	sort.Slice(lights, func(i, j int) bool {
+		return lights[i].addr < lights[j].addr
+	})
+	return lights, nil
+}
+
+// Connects to the light, unless it's connected already, and checks whether it has characteristics the bridge can
+// detect
+func checkLightCharacteristics(adapter *adapter1.Adapter1, light *scannedLight) {
+	light.checked = true
+
+	device, err := adapter.GetDeviceByAddress(light.addr)
+	if err != nil {
+		light.checkErr = errors.New(fmt.Sprintf("unable to get device: %v", err))
+		return
+	}
+
+	if connected, _ := device.GetConnected(); connected {
+		// Probably the bridge is using it, leave it connected
+		defer device.Close()
+	} else {
+		log.Debugf("connecting to '%s'...", light.addr)
+		if err := device.Connect(); err != nil {
+			device.Close()
+			light.checkErr = errors.New(fmt.Sprintf("unable to connect: %v", err))
+			return
+		}
+		defer disconnectDevice(device)
+	}
+
+	if resolved, err := waitServicesResolved(context.Background(), device, light.addr); !resolved {
+		light.checkErr = err
+		return
+	}
+
+	probed, err := probeCharacteristics(device)
+	if err != nil {
+		log.Warningf("unable to detect characteristics of '%s': %v", light.addr, err)
+		logCharacteristics(device)
+	}
+	light.probed = probed
+}
+
+// Mountpoint for the light made out of its name, or its address if there's no name or it's taken already
+func scannedLightMountpoint(light *scannedLight, taken map[string]bool) string {
+	mountpoint := strings.Trim(mountpointUnsafeRegexp.ReplaceAllString(strings.ToLower(light.name), "_"), "_")
+	if mountpoint == "" || taken[mountpoint] {
+		suffix := strings.ToLower(strings.Replace(light.addr, ":", "", -1))
+		mountpoint = strings.TrimPrefix(mountpoint+"_"+suffix, "_")
+	}
+	taken[mountpoint] = true
+	return mountpoint + "/"
+}
+
+// Writes a devices section that can be pasted into the config file, with what was found out about every light in
+// the comment above it
+func printDevicesConfig(out io.Writer, lights []*scannedLight) {
+	taken := make(map[string]bool)
+	_, _ = fmt.Fprintln(out, "devices:")
+	for _, light := range lights {
+		info := light.name
+		if info == "" {
+			info = "unnamed"
+		}
+		if light.rssi != nil {
+			info += fmt.Sprintf(", RSSI %d dBm", *light.rssi)
+		} else {
+			info += ", connected"
+		}
+		_, _ = fmt.Fprintf(out, "  # %s\n", info)
+
+		switch {
+		case !light.checked:
+		case light.checkErr != nil:
+			_, _ = fmt.Fprintf(out, "  # characteristics not checked: %v\n", light.checkErr)
+		case light.probed == nil:
+			_, _ = fmt.Fprintln(out, "  # characteristics not detected, set rgb_characteristic and notify_characteristic")
+		default:
+			_, _ = fmt.Fprintf(out, "  # %s characteristics: write %s, notify %s\n",
+				light.probed.layout, light.probed.write.uuid, light.probed.notify.uuid)
+		}
+
+		_, _ = fmt.Fprintf(out, "  %s:\n", quoteYAMLString(light.addr))
+		_, _ = fmt.Fprintf(out, "    mountpoint: %s\n", quoteYAMLString(scannedLightMountpoint(light, taken)))
+	}
+}
+
+// Looks for Triones lights and prints a devices section for them. Returns the exit code.
+func runScan(args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	timeout := flags.Duration("timeout", defaultScanTimeout, "how long to look for lights")
+	adapterID := flags.String("adapter", "", "Bluetooth adapter to use instead of the default one")
+	noConnect := flags.Bool("no-connect", false, "don't connect to the lights to check their characteristics")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: %s scan [--timeout duration] [--adapter hciX] [--no-connect]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var config Config
+	if *adapterID != "" {
+		config.Bluetooth = &BluetoothConfig{Adapter: adapterID}
+	}
+	adapter := getPoweredAdapterOrDie(&config)
+	defer adapter.Close()
+
+	lights, err := discoverLights(adapter, *timeout)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if len(lights) == 0 {
+		log.Warning("no lights found")
+		return 1
+	}
+	log.Infof("found %d lights", len(lights))
+
+	if !*noConnect {
+		for _, light := range lights {
+			log.Infof("checking characteristics of '%s'...", light.addr)
+			checkLightCharacteristics(adapter, light)
+		}
+	}
+
+	printDevicesConfig(os.Stdout, lights)
+	return 0
+}
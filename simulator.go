@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/Depau/consmart-ble-mqtt/triones"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// How long one step of a built-in animation lasts at speed 1, steps get longer linearly with the speed
+	simulatedStepDuration = 200 * time.Millisecond
+	// Delay between a status request and the notification carrying the answer
+	simulatedResponseDelay = 30 * time.Millisecond
+)
+
+type simulatedColor struct {
+	r, g, b float64
+}
+
+var (
+	simRed     = simulatedColor{255, 0, 0}
+	simGreen   = simulatedColor{0, 255, 0}
+	simBlue    = simulatedColor{0, 0, 255}
+	simYellow  = simulatedColor{255, 255, 0}
+	simCyan    = simulatedColor{0, 255, 255}
+	simMagenta = simulatedColor{255, 0, 255}
+	simWhite   = simulatedColor{255, 255, 255}
+	simBlack   = simulatedColor{0, 0, 0}
+	simRainbow = []simulatedColor{simRed, simGreen, simBlue, simYellow, simCyan, simMagenta, simWhite}
+	simRGB     = []simulatedColor{simRed, simGreen, simBlue}
+)
+
+type animationStyle int
+
+const (
+	// Crossfade from one color to the next
+	animationFade animationStyle = iota
+	// Each color fades in and out
+	animationPulse
+	// Each color flashes on and off
+	animationStrobe
+	// Each color is shown for a step, then the next one
+	animationJump
+)
+
+type simulatedAnimation struct {
+	style   animationStyle
+	palette []simulatedColor
+}
+
+// How the simulated bulb renders the built-in modes, modelled after what the real lights look like
+var simulatedAnimations = map[triones.Mode]simulatedAnimation{
+	37: {animationFade, simRainbow},
+	38: {animationPulse, []simulatedColor{simRed}},
+	39: {animationPulse, []simulatedColor{simGreen}},
+	40: {animationPulse, []simulatedColor{simBlue}},
+	41: {animationPulse, []simulatedColor{simYellow}},
+	42: {animationPulse, []simulatedColor{simCyan}},
+	43: {animationPulse, []simulatedColor{simMagenta}},
+	44: {animationPulse, []simulatedColor{simWhite}},
+	45: {animationPulse, []simulatedColor{simRed, simGreen}},
+	46: {animationPulse, []simulatedColor{simRed, simBlue}},
+	47: {animationPulse, []simulatedColor{simGreen, simBlue}},
+	48: {animationStrobe, simRainbow},
+	49: {animationStrobe, []simulatedColor{simRed}},
+	50: {animationStrobe, []simulatedColor{simGreen}},
+	51: {animationStrobe, []simulatedColor{simBlue}},
+	52: {animationStrobe, []simulatedColor{simYellow}},
+	53: {animationStrobe, []simulatedColor{simCyan}},
+	54: {animationStrobe, []simulatedColor{simMagenta}},
+	55: {animationStrobe, []simulatedColor{simWhite}},
+	56: {animationJump, simRainbow},
+	97: {animationPulse, simRGB},
+	98: {animationStrobe, simRGB},
+	99: {animationJump, simRGB},
+}
+
+func mixColors(from simulatedColor, to simulatedColor, amount float64) simulatedColor {
+	return simulatedColor{
+		r: from.r + (to.r-from.r)*amount,
+		g: from.g + (to.g-from.g)*amount,
+		b: from.b + (to.b-from.b)*amount,
+	}
+}
+
+// Color shown by the animation after the given number of steps
+func (animation simulatedAnimation) colorAt(steps float64) simulatedColor {
+	n := len(animation.palette)
+	index := int(math.Floor(steps)) % n
+	phase := steps - math.Floor(steps)
+	color := animation.palette[index]
+
+	switch animation.style {
+	case animationFade:
+		return mixColors(color, animation.palette[(index+1)%n], phase)
+	case animationPulse:
+		return mixColors(simBlack, color, 1-math.Abs(2*phase-1))
+	case animationStrobe:
+		if phase < 0.5 {
+			return color
+		}
+		return simBlack
+	default:
+		return color
+	}
+}
+
+// In-memory Triones light, for running the bridge without Bluetooth lights.
+//
+// It answers status requests with status frames like a real light would, and steps through the built-in modes at the
+// requested speed so the color reported while a mode is running keeps changing.
+type simulatedBulb struct {
+	lock             *sync.Mutex
+	status           triones.Status
+	modeStarted      time.Time
+	frameChan        chan []byte
+	unsubscribedChan chan interface{}
+}
+
+func NewSimulatedBulb() Transport {
+	return &simulatedBulb{
+		lock: &sync.Mutex{},
+		status: triones.Status{
+			Power: true,
+			Mode:  triones.ModeControl,
+			White: 255,
+		},
+	}
+}
+
+func (bulb *simulatedBulb) Write(payload []byte) error {
+	command, err := triones.DecodeCommand(payload)
+	if err != nil {
+		return err
+	}
+
+	bulb.lock.Lock()
+	defer bulb.lock.Unlock()
+
+	switch command := command.(type) {
+	case triones.SetColor:
+		bulb.status.Mode = triones.ModeControl
+		bulb.status.R, bulb.status.G, bulb.status.B = command.R, command.G, command.B
+		bulb.status.White = 0
+	case triones.SetWhite:
+		bulb.status.Mode = triones.ModeControl
+		bulb.status.R, bulb.status.G, bulb.status.B = 0, 0, 0
+		bulb.status.White = command.Intensity
+	case triones.SetPower:
+		bulb.status.Power = command.On
+	case triones.SetMode:
+		bulb.status.Mode = command.Mode
+		bulb.status.Speed = command.Speed
+		bulb.status.White = 0
+		bulb.modeStarted = time.Now()
+	case triones.RequestStatus:
+		frame := triones.EncodeStatus(bulb.currentStatus())
+		if bulb.frameChan != nil {
+			go bulb.notify(bulb.frameChan, bulb.unsubscribedChan, frame)
+		}
+	}
+	return nil
+}
+
+// Status including the color the current animation is showing. Must be called with the lock held.
+func (bulb *simulatedBulb) currentStatus() triones.Status {
+	status := bulb.status
+	if animation, ok := simulatedAnimations[status.Mode]; ok {
+		stepDuration := simulatedStepDuration * time.Duration(status.Speed)
+		steps := float64(time.Since(bulb.modeStarted)) / float64(stepDuration)
+		color := animation.colorAt(steps)
+		status.R = uint8(math.Round(color.r))
+		status.G = uint8(math.Round(color.g))
+		status.B = uint8(math.Round(color.b))
+	}
+	return status
+}
+
+func (bulb *simulatedBulb) notify(frameChan chan<- []byte, unsubscribedChan <-chan interface{}, frame []byte) {
+	select {
+	case <-time.After(simulatedResponseDelay):
+	case <-unsubscribedChan:
+		return
+	}
+	select {
+	case frameChan <- frame:
+	case <-unsubscribedChan:
+	}
+}
+
+func (bulb *simulatedBulb) Subscribe() (<-chan []byte, error) {
+	bulb.lock.Lock()
+	defer bulb.lock.Unlock()
+
+	if bulb.frameChan != nil {
+		return nil, ErrAlreadySubscribed
+	}
+	frameChan := make(chan []byte)
+	unsubscribedChan := make(chan interface{})
+	bulb.frameChan = frameChan
+	bulb.unsubscribedChan = unsubscribedChan
+
+	notificationChan := make(chan []byte)
+	go func() {
+		defer close(notificationChan)
+		for {
+			select {
+			case frame := <-frameChan:
+				select {
+				case notificationChan <- frame:
+				case <-unsubscribedChan:
+					return
+				}
+			case <-unsubscribedChan:
+				return
+			}
+		}
+	}()
+	return notificationChan, nil
+}
+
+func (bulb *simulatedBulb) Unsubscribe() error {
+	bulb.lock.Lock()
+	defer bulb.lock.Unlock()
+
+	if bulb.frameChan != nil {
+		close(bulb.unsubscribedChan)
+		bulb.frameChan = nil
+		bulb.unsubscribedChan = nil
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"github.com/Depau/consmart-ble-mqtt/triones"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Drives a simulated bulb through bleLight and the controller, checking the status it reports after each command
+func TestSimulatedBulb(t *testing.T) {
+	deviceConfig := &DeviceConfig{}
+	statusChan := make(chan LightStatus, 8)
+	frameErrorChan := make(chan *triones.FrameError, 8)
+	light := NewBleLight(NewSimulatedBulb(), statusChan, frameErrorChan, 0, nil, nil,
+		deviceLogger(bleLog, "00:00:00:00:00:00", "test"))
+	// Not running, the status requests are sent by the test
+	poller := newStatusPoller(light, deviceConfig, nil, nil, nil)
+	states, _ := newStateStore("")
+	controller := newLightController(light, poller, newFader(light, poller, deviceConfig),
+		getColorTempSettings(deviceConfig), "00:00:00:00:00:00", states, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	for _, run := range []func(context.Context) error{light.RunWriter, light.ListenNotifications} {
+		wg.Add(1)
+		go func(run func(context.Context) error) {
+			defer wg.Done()
+			if err := run(ctx); err != nil {
+				t.Error(err)
+			}
+		}(run)
+	}
+	defer wg.Wait()
+	defer cancel()
+
+	// Requests sent before the notifications are subscribed to go unanswered
+	initial := LightStatus{Power: true, Mode: "control", WarmWhite: true, WarmWhiteIntensity: 255}
+	deadline := time.Now().Add(time.Second)
+	for subscribed := false; !subscribed; {
+		if time.Now().After(deadline) {
+			t.Fatal("no status received")
+		}
+		if err := light.RequestLightStatus(); err != nil {
+			t.Fatalf("RequestLightStatus() failed: %v", err)
+		}
+		select {
+		case status := <-statusChan:
+			if status != initial {
+				t.Errorf("initial status = %+v, want %+v", status, initial)
+			}
+			subscribed = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	for _, test := range []struct {
+		command string
+		want    LightStatus
+	}{
+		{
+			`{"state": "ON", "color": {"r": 255, "g": 134, "b": 17}}`,
+			LightStatus{Power: true, Mode: "control", R: 255, G: 134, B: 17},
+		},
+		{
+			`{"white": 200}`,
+			LightStatus{Power: true, Mode: "control", WarmWhite: true, WarmWhiteIntensity: 200},
+		},
+		{
+			`{"state": "OFF"}`,
+			LightStatus{Power: false, Mode: "control", WarmWhite: true, WarmWhiteIntensity: 200},
+		},
+		{
+			`{"state": "ON", "color": {"r": 0, "g": 0, "b": 255}}`,
+			LightStatus{Power: true, Mode: "control", B: 255},
+		},
+		{
+			`{"effect": "red strobe", "speed": 31}`,
+			LightStatus{Power: true, Mode: "red strobe", WarmWhite: true, Speed: 31},
+		},
+		{
+			// The light keeps the speed of the last mode
+			`{"color": {"r": 10, "g": 20, "b": 30}}`,
+			LightStatus{Power: true, Mode: "control", R: 10, G: 20, B: 30, Speed: 31},
+		},
+	} {
+		command, err := ParseJSONCommand([]byte(test.command))
+		if err != nil {
+			t.Fatalf("%s: %v", test.command, err)
+		}
+		if err := controller.Apply(command); err != nil {
+			t.Fatalf("%s: Apply() failed: %v", test.command, err)
+		}
+		// Queued after the command, so it's answered with the status the command led to
+		if err := light.RequestLightStatus(); err != nil {
+			t.Fatalf("%s: RequestLightStatus() failed: %v", test.command, err)
+		}
+
+		select {
+		case status := <-statusChan:
+			if status.Mode != "control" {
+				// The animation of a built-in mode keeps changing the color
+				status.R, status.G, status.B = 0, 0, 0
+			}
+			if status != test.want {
+				t.Errorf("%s: status = %+v, want %+v", test.command, status, test.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no status received", test.command)
+		}
+	}
+
+	select {
+	case frameErr := <-frameErrorChan:
+		t.Errorf("bad frame received: %v", frameErr)
+	default:
+	}
+}
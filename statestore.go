@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the state file waits for more changes before it's saved, so dragging a color picker around doesn't
+// rewrite it for every color
+const stateSaveDelay = 2 * time.Second
+
+// Last state each light was commanded to be in through the control topics, as the command that brings it there.
+//
+// It's kept in memory, so lights can be restored when they reconnect, and optionally saved to a file so it survives
+// restarts of the bridge. The file holds the command for each address, in the same format control/set takes.
+type stateStore struct {
+	lock   *sync.Mutex
+	path   string
+	states map[string]*LightCommand
+	// Signalled when the states change and have to be saved
+	changedChan chan interface{}
+}
+
+// Returns the store, loaded from the file if path is set and the file exists
+func newStateStore(path string) (*stateStore, error) {
+	store := &stateStore{
+		lock:        &sync.Mutex{},
+		path:        path,
+		states:      make(map[string]*LightCommand),
+		changedChan: make(chan interface{}, 1),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &store.states); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to parse state file: %v", err))
+	}
+	return store, nil
+}
+
+func stateKey(addr string) string {
+	return strings.ToUpper(addr)
+}
+
+// Returns a copy of the last commanded state of the light, nil if it was never commanded anything
+func (store *stateStore) Commanded(addr string) *LightCommand {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	state, ok := store.states[stateKey(addr)]
+	if !ok {
+		return nil
+	}
+	stateCopy := *state
+	return &stateCopy
+}
+
+// Merges a command that was sent to the light into its last commanded state
+func (store *stateStore) Record(addr string, command *LightCommand) {
+	store.lock.Lock()
+	state, ok := store.states[stateKey(addr)]
+	if !ok {
+		state = &LightCommand{}
+		store.states[stateKey(addr)] = state
+	}
+	state.Merge(command)
+	store.lock.Unlock()
+	store.changed()
+}
+
+// Forgets about a light that is not configured anymore
+func (store *stateStore) Remove(addr string) {
+	store.lock.Lock()
+	delete(store.states, stateKey(addr))
+	store.lock.Unlock()
+	store.changed()
+}
+
+func (store *stateStore) changed() {
+	select {
+	case store.changedChan <- nil:
+	default:
+	}
+}
+
+func (store *stateStore) save() error {
+	store.lock.Lock()
+	content, err := json.MarshalIndent(store.states, "", "  ")
+	store.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, append(content, '\n'))
+}
+
+// Saves the states to the file whenever they change, until ctx is cancelled. Only needed if there's a file.
+func (store *stateStore) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-store.changedChan:
+			// Give more changes the chance to come in, unless the bridge is stopping
+			sleepContext(ctx, stateSaveDelay)
+		case <-ctx.Done():
+			// Unless something changed right before
+			select {
+			case <-store.changedChan:
+			default:
+				return nil
+			}
+		}
+
+		// Whatever changed in the meantime is saved now
+		select {
+		case <-store.changedChan:
+		default:
+		}
+		if err := store.save(); err != nil {
+			log.Error("unable to save state file: ", err)
+		}
+	}
+}
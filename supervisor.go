@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	device2 "github.com/muka/go-bluetooth/bluez/profile/device"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 2 * time.Minute
+	// Children that stay up at least this long reset their restart backoff
+	stableRunTime = 1 * time.Minute
+	// Used as maxRestarts for supervisors that never give up
+	unlimitedRestarts = -1
+)
+
+var ErrSupervisorRunning = errors.New("supervisor is already running")
+var ErrChildExists = errors.New("a child with the same name already exists")
+var ErrNoSuchChild = errors.New("no such child")
+
+// Exponential backoff with "full jitter": each delay is picked at random between min and the current ceiling, which
+// doubles at every attempt up to max. This avoids reconnecting to all the lights in lockstep after they all dropped at
+// once, such as after a power cut.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	return &backoff{min: min, max: max}
+}
+
+func (b *backoff) Next() time.Duration {
+	ceiling := b.max
+	if b.attempt < 32 {
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			ceiling = exp
+		}
+	}
+	b.attempt++
+
+	delay := b.min
+	if ceiling > b.min {
+		delay += time.Duration(rand.Int63n(int64(ceiling - b.min)))
+	}
+	return delay
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// What a supervisor does when one of its children stops
+type RestartStrategy int
+
+const (
+	// Only the child that stopped is restarted
+	OneForOne RestartStrategy = iota
+	// All the children are stopped and started again, for children that can't work without each other
+	OneForAll
+)
+
+// Whether a child is restarted when it stops
+type RestartPolicy int
+
+const (
+	// Always restarted
+	Permanent RestartPolicy = iota
+	// Restarted only if it failed
+	Transient
+	// Never restarted
+	Temporary
+)
+
+// Worker runs until its context is cancelled, in which case it should return nil, or until it fails.
+type Worker func(ctx context.Context) error
+
+type ChildSpec struct {
+	Name    string
+	Restart RestartPolicy
+	Run     Worker
+}
+
+// Returned by a supervisor that ran out of restarts for one of its children
+type ChildError struct {
+	Child string
+	Err   error
+}
+
+func (err *ChildError) Error() string {
+	return fmt.Sprintf("%s failed: %v", err.Child, err.Err)
+}
+
+func (err *ChildError) Unwrap() error {
+	return err.Err
+}
+
+type childRun struct {
+	cancel    context.CancelFunc
+	done      chan interface{}
+	startedAt time.Time
+}
+
+type child struct {
+	spec    ChildSpec
+	backoff *backoff
+	// Only touched by the goroutine running the supervisor, nil while the child is not running
+	run *childRun
+}
+
+type childExit struct {
+	child *child
+	run   *childRun
+	err   error
+}
+
+// Supervisor runs workers, its children, and restarts them according to their policy and to its strategy.
+//
+// Supervisors can be children of other supervisors, which is how the bridge is laid out:
+//
+//	devices (one-for-one, never gives up)
+//	└── device '<addr>': connects to the light, then runs
+//	    └── light '<addr>' (one-for-all, no restarts)
+//	        ├── writer, notifications, publisher, poller
+//	        └── connection watcher
+//
+// When a supervisor runs out of restarts it stops all of its children and returns a *ChildError, so the failure
+// propagates to its parent, which applies its own strategy. Cancelling the context stops the children one at a time,
+// in reverse order, waiting for each of them to return.
+//
+// Children can be added and removed while the supervisor is running.
+type Supervisor struct {
+	name     string
+	strategy RestartStrategy
+	// Restarts allowed over the lifetime of the supervisor, or unlimitedRestarts
+	maxRestarts int
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	log         *fieldLogger
+
+	lock *sync.Mutex
+	// Only touched while holding the lock if the supervisor is not running, or by the goroutine running it if it is
+	children    []*child
+	running     bool
+	requestChan chan func()
+	stoppedChan chan interface{}
+
+	// Only touched by the goroutine running the supervisor
+	ctx      context.Context
+	restarts int
+	exitChan chan childExit
+}
+
+func NewSupervisor(
+	name string,
+	strategy RestartStrategy,
+	maxRestarts int,
+	minDelay time.Duration,
+	maxDelay time.Duration,
+) *Supervisor {
+	return &Supervisor{
+		name:        name,
+		strategy:    strategy,
+		maxRestarts: maxRestarts,
+		minDelay:    minDelay,
+		maxDelay:    maxDelay,
+		log:         withFields(supervisorLog, "supervisor", name),
+		lock:        &sync.Mutex{},
+		exitChan:    make(chan childExit),
+	}
+}
+
+// Adds a child, starting it right away if the supervisor is running
+func (sup *Supervisor) Add(spec ChildSpec) error {
+	return sup.do(func(running bool) error {
+		for _, c := range sup.children {
+			if c.spec.Name == spec.Name {
+				return ErrChildExists
+			}
+		}
+		c := &child{spec: spec, backoff: newBackoff(sup.minDelay, sup.maxDelay)}
+		sup.children = append(sup.children, c)
+		if running {
+			sup.start(c, 0)
+		}
+		return nil
+	})
+}
+
+// Stops a child, waiting for it to return, and removes it
+func (sup *Supervisor) Remove(name string) error {
+	return sup.do(func(running bool) error {
+		for i, c := range sup.children {
+			if c.spec.Name != name {
+				continue
+			}
+			sup.stop(c)
+			sup.children = append(sup.children[:i], sup.children[i+1:]...)
+			return nil
+		}
+		return ErrNoSuchChild
+	})
+}
+
+// Runs fn in the goroutine running the supervisor, or right here, holding the lock, if it's not running. Either way
+// fn is the only one touching the children.
+func (sup *Supervisor) do(fn func(running bool) error) error {
+	for {
+		sup.lock.Lock()
+		if !sup.running {
+			defer sup.lock.Unlock()
+			return fn(false)
+		}
+		requestChan, stoppedChan := sup.requestChan, sup.stoppedChan
+		sup.lock.Unlock()
+
+		result := make(chan error, 1)
+		select {
+		case requestChan <- func() { result <- fn(true) }:
+			return <-result
+		case <-stoppedChan:
+			// Run() returned in the meantime, try again
+		}
+	}
+}
+
+// Checks that the goroutine running the supervisor is handling requests, rather than being stuck waiting for a child
+// that doesn't stop. Fails if it doesn't get to it before ctx is done. A supervisor that is not running is fine.
+func (sup *Supervisor) Ping(ctx context.Context) error {
+	sup.lock.Lock()
+	if !sup.running {
+		sup.lock.Unlock()
+		return nil
+	}
+	requestChan, stoppedChan := sup.requestChan, sup.stoppedChan
+	sup.lock.Unlock()
+
+	select {
+	case requestChan <- func() {}:
+		return nil
+	case <-stoppedChan:
+		return nil
+	case <-ctx.Done():
+		return errors.New(fmt.Sprintf("%s is not responding", sup.name))
+	}
+}
+
+// Runs the children until ctx is cancelled, which returns nil, or until the supervisor runs out of restarts.
+func (sup *Supervisor) Run(ctx context.Context) error {
+	sup.lock.Lock()
+	if sup.running {
+		sup.lock.Unlock()
+		return ErrSupervisorRunning
+	}
+	sup.running = true
+	sup.requestChan = make(chan func())
+	sup.stoppedChan = make(chan interface{})
+	children := append([]*child(nil), sup.children...)
+	sup.lock.Unlock()
+
+	sup.ctx = ctx
+	sup.restarts = 0
+	for _, c := range children {
+		sup.start(c, 0)
+	}
+
+	err := sup.loop(ctx)
+	sup.stopAll()
+	sup.log.Debugf("%s stopped", sup.name)
+
+	sup.lock.Lock()
+	sup.running = false
+	close(sup.stoppedChan)
+	sup.lock.Unlock()
+	return err
+}
+
+func (sup *Supervisor) loop(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case request := <-sup.requestChan:
+			request()
+		case exit := <-sup.exitChan:
+			if exit.run != exit.child.run {
+				// Stopped on purpose
+				continue
+			}
+			if err := sup.handleExit(exit); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (sup *Supervisor) handleExit(exit childExit) error {
+	c := exit.child
+	c.run = nil
+
+	if c.spec.Restart == Temporary || (c.spec.Restart == Transient && exit.err == nil) {
+		if exit.err != nil {
+			sup.log.Errorf("%s failed: %v", c.spec.Name, exit.err)
+		} else {
+			sup.log.Debugf("%s stopped", c.spec.Name)
+		}
+		return nil
+	}
+
+	err := exit.err
+	if err == nil {
+		err = errors.New("stopped unexpectedly")
+	}
+	if sup.maxRestarts != unlimitedRestarts && sup.restarts >= sup.maxRestarts {
+		return &ChildError{Child: c.spec.Name, Err: err}
+	}
+	sup.restarts++
+
+	if time.Since(exit.run.startedAt) >= stableRunTime {
+		c.backoff.Reset()
+	}
+	delay := c.backoff.Next()
+	sup.log.Warningf("%s failed, restarting in %v: %v", c.spec.Name, delay.Round(time.Millisecond), err)
+
+	switch sup.strategy {
+	case OneForOne:
+		sup.start(c, delay)
+	case OneForAll:
+		sup.stopAll()
+		for _, other := range sup.children {
+			if other.spec.Restart != Temporary {
+				sup.start(other, delay)
+			}
+		}
+	}
+	return nil
+}
+
+func (sup *Supervisor) start(c *child, delay time.Duration) {
+	ctx, cancel := context.WithCancel(sup.ctx)
+	run := &childRun{
+		cancel:    cancel,
+		done:      make(chan interface{}),
+		startedAt: time.Now().Add(delay),
+	}
+	c.run = run
+
+	go func() {
+		defer close(run.done)
+
+		var err error
+		if sleepContext(ctx, delay) {
+			err = runWorker(ctx, c.spec.Run)
+		}
+		if ctx.Err() != nil {
+			// Stopped by the supervisor
+			return
+		}
+		select {
+		case sup.exitChan <- childExit{child: c, run: run, err: err}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// Turns panics into errors, so they're handled like any other failure
+func runWorker(ctx context.Context, worker Worker) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("panic: %v", r))
+		}
+	}()
+	return worker(ctx)
+}
+
+func (sup *Supervisor) stop(c *child) {
+	if c.run == nil {
+		return
+	}
+	c.run.cancel()
+	<-c.run.done
+	c.run = nil
+}
+
+// Stops the children in reverse order
+func (sup *Supervisor) stopAll() {
+	for i := len(sup.children) - 1; i >= 0; i-- {
+		sup.stop(sup.children[i])
+	}
+}
+
+// Waits for the given delay, returns false if the context was cancelled in the meantime.
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func isIOError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Input/output error")
+}
+
+// Asks the main goroutine to reset the Bluetooth adapter, without blocking if a reset was already requested.
+func requestBluetoothReset(bluetoothResetChan chan<- bool) {
+	bridgeMetrics.BluetoothResetRequested()
+	select {
+	case bluetoothResetChan <- true:
+	default:
+	}
+}
+
+// Watches the device's Connected property on its own D-Bus subscription and fails as soon as the device disconnects.
+// Notifications from the light just stop coming when it goes away, so this is the only reliable way to find out.
+func watchDeviceConnection(ctx context.Context, device *device2.Device1) error {
+	addr, _ := device.GetAddress()
+
+	watch, err := watchProperties(device.Client(), device.Path())
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to watch connection state of '%s': %v", addr, err))
+	}
+	defer watch.Close()
+
+	// The device might have disconnected before we started watching
+	if connected, err := device.GetConnected(); err != nil || !connected {
+		return errors.New(fmt.Sprintf("device '%s' is not connected anymore", addr))
+	}
+
+	for {
+		select {
+		case prop, ok := <-watch.Changes():
+			if !ok {
+				return errors.New(fmt.Sprintf("connection state of '%s' is not being watched anymore", addr))
+			}
+			if prop.Interface != device2.Device1Interface || prop.Name != "Connected" {
+				continue
+			}
+			if connected, ok := prop.Value.(bool); ok && !connected {
+				return errors.New(fmt.Sprintf("device '%s' disconnected", addr))
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
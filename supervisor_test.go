@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testRestartDelay = time.Millisecond
+	testTimeout      = time.Second
+)
+
+var errTestFailure = errors.New("test failure")
+
+// Children run by the supervisors under test. Each start is reported on starts; a child returns what is sent on its
+// exit channel, or nil once it's cancelled.
+type testChildren struct {
+	starts  chan string
+	exits   map[string]chan error
+	running *int32
+}
+
+func newTestChildren() *testChildren {
+	return &testChildren{
+		starts:  make(chan string, 64),
+		exits:   make(map[string]chan error),
+		running: new(int32),
+	}
+}
+
+func (children *testChildren) spec(name string, restart RestartPolicy) ChildSpec {
+	exitChan := make(chan error, 1)
+	children.exits[name] = exitChan
+	return ChildSpec{
+		Name:    name,
+		Restart: restart,
+		Run: func(ctx context.Context) error {
+			atomic.AddInt32(children.running, 1)
+			defer atomic.AddInt32(children.running, -1)
+			children.starts <- name
+			select {
+			case err := <-exitChan:
+				return err
+			case <-ctx.Done():
+				// Take a while to stop, so returning early would be noticed
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			}
+		},
+	}
+}
+
+func (children *testChildren) exit(name string, err error) {
+	children.exits[name] <- err
+}
+
+// Waits for the children to start, in any order
+func (children *testChildren) expectStarts(t *testing.T, names ...string) {
+	t.Helper()
+	var started []string
+	for range names {
+		select {
+		case name := <-children.starts:
+			started = append(started, name)
+		case <-time.After(testTimeout):
+			t.Fatalf("started %v, want %v", started, names)
+		}
+	}
+	sort.Strings(started)
+	want := append([]string(nil), names...)
+	sort.Strings(want)
+	for i := range want {
+		if started[i] != want[i] {
+			t.Fatalf("started %v, want %v", started, want)
+		}
+	}
+}
+
+// Checks that no child starts for a while
+func (children *testChildren) expectNoStart(t *testing.T) {
+	t.Helper()
+	select {
+	case name := <-children.starts:
+		t.Fatalf("%s started, want no start", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Runs the supervisor in the background, returns what cancels it and where Run returns
+func runSupervisor(sup *Supervisor) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- sup.Run(ctx)
+	}()
+	return cancel, result
+}
+
+func stopSupervisor(t *testing.T, cancel context.CancelFunc, result <-chan error) {
+	t.Helper()
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Run() = %v, want nil", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Run() didn't return")
+	}
+}
+
+func TestSupervisorOneForAll(t *testing.T) {
+	children := newTestChildren()
+	sup := NewSupervisor("test", OneForAll, unlimitedRestarts, testRestartDelay, testRestartDelay)
+	for _, spec := range []ChildSpec{
+		children.spec("first", Permanent),
+		children.spec("second", Permanent),
+		children.spec("temporary", Temporary),
+	} {
+		if err := sup.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel, result := runSupervisor(sup)
+	children.expectStarts(t, "first", "second", "temporary")
+
+	// The sibling is restarted along with the child that failed, temporary children are only stopped
+	children.exit("first", errTestFailure)
+	children.expectStarts(t, "first", "second")
+	children.expectNoStart(t)
+	if running := atomic.LoadInt32(children.running); running != 2 {
+		t.Errorf("%d children running, want 2", running)
+	}
+
+	children.exit("second", errTestFailure)
+	children.expectStarts(t, "first", "second")
+	stopSupervisor(t, cancel, result)
+}
+
+func TestSupervisorRestartPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy    RestartPolicy
+		err       error
+		restarted bool
+	}{
+		{Permanent, nil, true},
+		{Permanent, errTestFailure, true},
+		{Transient, nil, false},
+		{Transient, errTestFailure, true},
+		{Temporary, nil, false},
+		{Temporary, errTestFailure, false},
+	} {
+		children := newTestChildren()
+		sup := NewSupervisor("test", OneForOne, unlimitedRestarts, testRestartDelay, testRestartDelay)
+		if err := sup.Add(children.spec("child", test.policy)); err != nil {
+			t.Fatal(err)
+		}
+		cancel, result := runSupervisor(sup)
+		children.expectStarts(t, "child")
+
+		children.exit("child", test.err)
+		if test.restarted {
+			children.expectStarts(t, "child")
+		} else {
+			children.expectNoStart(t)
+		}
+		stopSupervisor(t, cancel, result)
+	}
+}
+
+func TestSupervisorMaxRestarts(t *testing.T) {
+	children := newTestChildren()
+	sup := NewSupervisor("test", OneForOne, 2, testRestartDelay, testRestartDelay)
+	if err := sup.Add(children.spec("child", Permanent)); err != nil {
+		t.Fatal(err)
+	}
+	cancel, result := runSupervisor(sup)
+	defer cancel()
+
+	for i := 0; i <= 2; i++ {
+		children.expectStarts(t, "child")
+		children.exit("child", errTestFailure)
+	}
+
+	select {
+	case err := <-result:
+		var childErr *ChildError
+		if !errors.As(err, &childErr) || childErr.Child != "child" || !errors.Is(err, errTestFailure) {
+			t.Fatalf("Run() = %v, want a *ChildError for child wrapping %v", err, errTestFailure)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Run() didn't return")
+	}
+	children.expectNoStart(t)
+}
+
+func TestSupervisorAddRemove(t *testing.T) {
+	children := newTestChildren()
+	sup := NewSupervisor("test", OneForOne, unlimitedRestarts, testRestartDelay, testRestartDelay)
+	if err := sup.Add(children.spec("first", Permanent)); err != nil {
+		t.Fatal(err)
+	}
+	cancel, result := runSupervisor(sup)
+	children.expectStarts(t, "first")
+
+	if err := sup.Add(children.spec("second", Permanent)); err != nil {
+		t.Fatal(err)
+	}
+	children.expectStarts(t, "second")
+	if err := sup.Add(ChildSpec{Name: "second", Run: func(ctx context.Context) error { return nil }}); err != ErrChildExists {
+		t.Errorf("Add() of an existing child = %v, want %v", err, ErrChildExists)
+	}
+
+	if err := sup.Remove("first"); err != nil {
+		t.Fatal(err)
+	}
+	// Remove waits for the child to return
+	if running := atomic.LoadInt32(children.running); running != 1 {
+		t.Errorf("%d children running after Remove(), want 1", running)
+	}
+	if err := sup.Remove("first"); err != ErrNoSuchChild {
+		t.Errorf("Remove() of a removed child = %v, want %v", err, ErrNoSuchChild)
+	}
+
+	// The removed child is gone for good, the other one is still supervised
+	children.exit("second", errTestFailure)
+	children.expectStarts(t, "second")
+	children.expectNoStart(t)
+	stopSupervisor(t, cancel, result)
+}
+
+func TestSupervisorPing(t *testing.T) {
+	sup := NewSupervisor("test", OneForOne, unlimitedRestarts, testRestartDelay, testRestartDelay)
+	if err := sup.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() of a stopped supervisor = %v, want nil", err)
+	}
+
+	// Doesn't return once it's cancelled until it's released
+	started := make(chan interface{})
+	cancelled := make(chan interface{})
+	release := make(chan interface{})
+	err := sup.Add(ChildSpec{Name: "stuck", Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		<-release
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel, result := runSupervisor(sup)
+	<-started
+
+	ctx, cancelPing := context.WithTimeout(context.Background(), testTimeout)
+	if err := sup.Ping(ctx); err != nil {
+		t.Errorf("Ping() of a running supervisor = %v, want nil", err)
+	}
+	cancelPing()
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- sup.Remove("stuck")
+	}()
+	<-cancelled
+	ctx, cancelPing = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if err := sup.Ping(ctx); err == nil {
+		t.Error("Ping() of a supervisor stuck stopping a child = nil, want an error")
+	}
+	cancelPing()
+
+	close(release)
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	stopSupervisor(t, cancel, result)
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	children := newTestChildren()
+	sup := NewSupervisor("test", OneForOne, unlimitedRestarts, testRestartDelay, testRestartDelay)
+	nested := NewSupervisor("nested", OneForAll, 0, testRestartDelay, testRestartDelay)
+	for _, spec := range []ChildSpec{
+		children.spec("first", Permanent),
+		children.spec("nested first", Permanent),
+		children.spec("nested second", Transient),
+		children.spec("last", Temporary),
+	} {
+		supervisor := sup
+		if spec.Name == "nested first" || spec.Name == "nested second" {
+			supervisor = nested
+		}
+		if err := supervisor.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sup.Add(ChildSpec{Name: "nested", Restart: Permanent, Run: nested.Run}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel, result := runSupervisor(sup)
+	children.expectStarts(t, "first", "nested first", "nested second", "last")
+	stopSupervisor(t, cancel, result)
+	if running := atomic.LoadInt32(children.running); running != 0 {
+		t.Errorf("%d children still running after Run() returned", running)
+	}
+}
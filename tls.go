@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variables that override the MQTT credentials from the configuration
+const (
+	usernameEnvVar = "CONSMART_MQTT_USERNAME"
+	passwordEnvVar = "CONSMART_MQTT_PASSWORD"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func NewTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify || config.Insecure,
+	}
+
+	if config.CAFile != nil {
+		pem, err := ioutil.ReadFile(*config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in CA file '%s'", *config.CAFile))
+		}
+	}
+
+	if (config.CertFile == nil) != (config.KeyFile == nil) {
+		return nil, errors.New("both 'cert_file' and 'key_file' must be set to use a client certificate")
+	}
+	if config.CertFile != nil {
+		cert, err := tls.LoadX509KeyPair(*config.CertFile, *config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.ServerName != nil {
+		tlsConfig.ServerName = *config.ServerName
+	}
+
+	if config.MinVersion != nil {
+		version, ok := tlsVersions[*config.MinVersion]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid TLS version '%s', must be one of 1.0, 1.1, 1.2, 1.3", *config.MinVersion))
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	return tlsConfig, nil
+}
+
+// Returns the MQTT credentials. The environment takes precedence over password_file, which takes precedence over the
+// password in the configuration.
+func getCredentials(config *MQTTConfig) (username *string, password *string, err error) {
+	username = config.Username
+	password = config.Password
+
+	if config.PasswordFile != nil {
+		var content []byte
+		content, err = ioutil.ReadFile(*config.PasswordFile)
+		if err != nil {
+			return
+		}
+		filePassword := strings.TrimRight(string(content), "\r\n")
+		password = &filePassword
+	}
+
+	if envUsername, ok := os.LookupEnv(usernameEnvVar); ok {
+		username = &envUsername
+	}
+	if envPassword, ok := os.LookupEnv(passwordEnvVar); ok {
+		password = &envPassword
+	}
+	return
+}
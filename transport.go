@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"github.com/muka/go-bluetooth/bluez/profile/gatt"
+	"sync"
+)
+
+var ErrAlreadySubscribed = errors.New("already subscribed to notifications")
+
+// Transport carries bytes to and from a light: writes go to its write characteristic, notifications come from its
+// notify characteristic.
+type Transport interface {
+	// Write sends a command to the light
+	Write(payload []byte) error
+	// Subscribe starts notifications. The returned channel is closed after Unsubscribe() is called, or when the
+	// transport can't deliver notifications anymore.
+	Subscribe() (<-chan []byte, error)
+	// Unsubscribe stops notifications
+	Unsubscribe() error
+}
+
+// Transport backed by BlueZ GATT characteristics
+type bluezTransport struct {
+	writeCharacteristic  *gatt.GattCharacteristic1
+	notifyCharacteristic *gatt.GattCharacteristic1
+	lock                 *sync.Mutex
+	propertyWatch        *propertyWatch
+	unsubscribedChan     chan interface{}
+}
+
+func NewBluezTransport(writeCharacteristic *gatt.GattCharacteristic1, notifyCharacteristic *gatt.GattCharacteristic1) Transport {
+	return &bluezTransport{
+		writeCharacteristic:  writeCharacteristic,
+		notifyCharacteristic: notifyCharacteristic,
+		lock:                 &sync.Mutex{},
+	}
+}
+
+func (transport *bluezTransport) Write(payload []byte) error {
+	return transport.writeCharacteristic.WriteValue(payload, nil)
+}
+
+func (transport *bluezTransport) Subscribe() (<-chan []byte, error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	if transport.propertyWatch != nil {
+		return nil, ErrAlreadySubscribed
+	}
+
+	char := transport.notifyCharacteristic
+	watch, err := watchProperties(char.Client(), char.Path())
+	if err != nil {
+		return nil, err
+	}
+	if err := char.StartNotify(); err != nil {
+		watch.Close()
+		return nil, err
+	}
+	transport.propertyWatch = watch
+	unsubscribedChan := make(chan interface{})
+	transport.unsubscribedChan = unsubscribedChan
+
+	notificationChan := make(chan []byte)
+	go func() {
+		defer close(notificationChan)
+		for prop := range watch.Changes() {
+			if prop.Interface != gatt.GattCharacteristic1Interface || prop.Name != "Value" {
+				continue
+			}
+			value, ok := prop.Value.([]byte)
+			if !ok {
+				bleLog.Debugf("unexpected notification value type %T", prop.Value)
+				continue
+			}
+			select {
+			case notificationChan <- value:
+			case <-unsubscribedChan:
+				return
+			}
+		}
+	}()
+	return notificationChan, nil
+}
+
+func (transport *bluezTransport) Unsubscribe() error {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	if transport.propertyWatch == nil {
+		return nil
+	}
+	// The light may be gone already, in which case there's nothing to stop
+	err := transport.notifyCharacteristic.StopNotify()
+	close(transport.unsubscribedChan)
+	transport.propertyWatch.Close()
+	transport.propertyWatch = nil
+	return err
+}
@@ -0,0 +1,130 @@
+package triones
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// MinSpeed is the fastest speed of the built-in modes
+	MinSpeed uint8 = 1
+	// MaxSpeed is the slowest speed of the built-in modes
+	MaxSpeed uint8 = 31
+)
+
+// Command is a command that can be written to the light
+type Command interface {
+	Encode() ([]byte, error)
+}
+
+// SetColor shows a color with the RGB LEDs
+type SetColor struct {
+	R uint8
+	G uint8
+	B uint8
+}
+
+// SetWhite shows the given intensity with the white LEDs
+type SetWhite struct {
+	Intensity uint8
+}
+
+// SetPower turns the light on or off, leaving the rest of the state untouched
+type SetPower struct {
+	On bool
+}
+
+// SetMode starts one of the built-in modes. Speed is inversely proportional: 1 is the fastest, 31 the slowest.
+type SetMode struct {
+	Mode  Mode
+	Speed uint8
+}
+
+// RequestStatus makes the light send a status frame as a notification
+type RequestStatus struct{}
+
+func encodeColor(r uint8, g uint8, b uint8, white uint8, useWhite bool) []byte {
+	payload := make([]byte, 7)
+	payload[0] = 0x56
+	payload[1] = r
+	payload[2] = g
+	payload[3] = b
+	payload[4] = white
+	if useWhite {
+		payload[5] = 0x0F
+	} else {
+		payload[5] = 0xF0
+	}
+	payload[6] = 0xAA
+	return payload
+}
+
+func (command SetColor) Encode() ([]byte, error) {
+	return encodeColor(command.R, command.G, command.B, 0, false), nil
+}
+
+func (command SetWhite) Encode() ([]byte, error) {
+	return encodeColor(0, 0, 0, command.Intensity, true), nil
+}
+
+func (command SetPower) Encode() ([]byte, error) {
+	payload := make([]byte, 3)
+	payload[0] = 0xCC
+	if command.On {
+		payload[1] = 0x23
+	} else {
+		payload[1] = 0x24
+	}
+	payload[2] = 0x33
+	return payload, nil
+}
+
+func (command SetMode) Encode() ([]byte, error) {
+	if !command.Mode.IsBuiltIn() {
+		if command.Mode == ModeControl {
+			return nil, errors.New("RGB control mode can't be set with SetMode")
+		}
+		return nil, errors.New(fmt.Sprintf("mode %d is not valid", uint8(command.Mode)))
+	}
+	if command.Speed > MaxSpeed || command.Speed < MinSpeed {
+		return nil, errors.New("speed must be between 1 and 31 (and is inversely proportional)")
+	}
+	return []byte{0xBB, uint8(command.Mode), command.Speed, 0x44}, nil
+}
+
+func (command RequestStatus) Encode() ([]byte, error) {
+	return []byte{0xEF, 0x01, 0x77}, nil
+}
+
+// DecodeCommand decodes a command, as the light would receive it
+func DecodeCommand(payload []byte) (Command, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	switch {
+	case payload[0] == 0x56 && len(payload) == 7 && payload[6] == 0xAA:
+		switch payload[5] {
+		case 0xF0:
+			return SetColor{R: payload[1], G: payload[2], B: payload[3]}, nil
+		case 0x0F:
+			return SetWhite{Intensity: payload[4]}, nil
+		}
+	case payload[0] == 0xCC && len(payload) == 3 && payload[2] == 0x33:
+		switch payload[1] {
+		case 0x23:
+			return SetPower{On: true}, nil
+		case 0x24:
+			return SetPower{On: false}, nil
+		}
+	case payload[0] == 0xBB && len(payload) == 4 && payload[3] == 0x44:
+		command := SetMode{Mode: Mode(payload[1]), Speed: payload[2]}
+		if _, err := command.Encode(); err != nil {
+			return nil, err
+		}
+		return command, nil
+	case payload[0] == 0xEF && len(payload) == 3 && payload[1] == 0x01 && payload[2] == 0x77:
+		return RequestStatus{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown command %x", payload))
+}
@@ -0,0 +1,84 @@
+package triones
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Bytes on the wire for each command, as sent by the vendor app
+var commandVectors = []struct {
+	name    string
+	command Command
+	payload []byte
+}{
+	{"color", SetColor{R: 255, G: 134, B: 17}, []byte{0x56, 0xFF, 0x86, 0x11, 0x00, 0xF0, 0xAA}},
+	{"black", SetColor{}, []byte{0x56, 0x00, 0x00, 0x00, 0x00, 0xF0, 0xAA}},
+	{"white", SetWhite{Intensity: 200}, []byte{0x56, 0x00, 0x00, 0x00, 0xC8, 0x0F, 0xAA}},
+	{"white off", SetWhite{Intensity: 0}, []byte{0x56, 0x00, 0x00, 0x00, 0x00, 0x0F, 0xAA}},
+	{"power on", SetPower{On: true}, []byte{0xCC, 0x23, 0x33}},
+	{"power off", SetPower{On: false}, []byte{0xCC, 0x24, 0x33}},
+	{"smooth rainbow", SetMode{Mode: 37, Speed: 10}, []byte{0xBB, 0x25, 0x0A, 0x44}},
+	{"hard RGB fastest", SetMode{Mode: 99, Speed: MinSpeed}, []byte{0xBB, 0x63, 0x01, 0x44}},
+	{"white strobe slowest", SetMode{Mode: 55, Speed: MaxSpeed}, []byte{0xBB, 0x37, 0x1F, 0x44}},
+	{"status request", RequestStatus{}, []byte{0xEF, 0x01, 0x77}},
+}
+
+func TestEncodeCommand(t *testing.T) {
+	for _, vector := range commandVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			payload, err := vector.command.Encode()
+			if err != nil {
+				t.Fatalf("Encode() failed: %v", err)
+			}
+			if !bytes.Equal(payload, vector.payload) {
+				t.Errorf("Encode() = % X, want % X", payload, vector.payload)
+			}
+		})
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	for _, vector := range commandVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			command, err := DecodeCommand(vector.payload)
+			if err != nil {
+				t.Fatalf("DecodeCommand() failed: %v", err)
+			}
+			if command != vector.command {
+				t.Errorf("DecodeCommand() = %#v, want %#v", command, vector.command)
+			}
+		})
+	}
+}
+
+func TestEncodeInvalidMode(t *testing.T) {
+	for _, command := range []SetMode{
+		{Mode: ModeControl, Speed: 10},
+		{Mode: 0, Speed: 10},
+		{Mode: 37, Speed: 0},
+		{Mode: 37, Speed: MaxSpeed + 1},
+	} {
+		if payload, err := command.Encode(); err == nil {
+			t.Errorf("%#v.Encode() = % X, want an error", command, payload)
+		}
+	}
+}
+
+func TestDecodeInvalidCommand(t *testing.T) {
+	for _, payload := range [][]byte{
+		nil,
+		{0x56, 0xFF, 0x86, 0x11, 0x00, 0xF0},
+		{0x56, 0xFF, 0x86, 0x11, 0x00, 0x00, 0xAA},
+		{0x56, 0xFF, 0x86, 0x11, 0x00, 0xF0, 0x00},
+		{0xCC, 0x25, 0x33},
+		{0xCC, 0x23},
+		{0xBB, 0x41, 0x0A, 0x44},
+		{0xBB, 0x25, 0x00, 0x44},
+		{0xEF, 0x01},
+		{0x12, 0x34},
+	} {
+		if command, err := DecodeCommand(payload); err == nil {
+			t.Errorf("DecodeCommand(% X) = %#v, want an error", payload, command)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// Package triones implements the protocol spoken by Triones/Flyidea/LEDBlue Bluetooth LE lights, sold under many
+// brands (Consmart and others).
+//
+// Commands are written to the light's write characteristic (usually ffd9), status frames come back as notifications on
+// the notify characteristic (usually ffd4) after a RequestStatus command.
+//
+// The package only deals with encoding and decoding bytes, it has no dependency on BlueZ or D-Bus.
+package triones
@@ -0,0 +1,70 @@
+package triones
+
+import "fmt"
+
+// Mode is the number of one of the light's modes
+type Mode uint8
+
+// ModeControl is the mode the light is in while showing a color set with SetColor or SetWhite. It can't be set with
+// SetMode.
+const ModeControl Mode = 65
+
+// Modes maps the name of the modes to their number
+var Modes = map[string]Mode{
+	"smooth rainbow":       37,
+	"pulsating red":        38,
+	"pulsating green":      39,
+	"pulsating blue":       40,
+	"pulsating yellow":     41,
+	"pulsating cyan":       42,
+	"pulsating magenta":    43,
+	"pulsating white":      44,
+	"pulsating red/green":  45,
+	"pulsating red/blue":   46,
+	"pulsating green/blue": 47,
+	"rainbow strobe":       48,
+	"red strobe":           49,
+	"green strobe":         50,
+	"blue strobe":          51,
+	"yellow strobe":        52,
+	"cyan strobe":          53,
+	"magenta strobe":       54,
+	"white strobe":         55,
+	"hard rainbow":         56,
+	"pulsating RGB":        97,
+	"RGB strobe":           98,
+	"hard RGB":             99,
+	"control":              ModeControl, // Not settable with SetMode
+}
+
+var modeNames = make(map[Mode]string)
+
+func init() {
+	for name, mode := range Modes {
+		modeNames[mode] = name
+	}
+}
+
+// ModeByName returns the mode with the given name
+func ModeByName(name string) (mode Mode, ok bool) {
+	mode, ok = Modes[name]
+	return
+}
+
+// Name returns the name of the mode, or an empty string if the mode is not known
+func (mode Mode) Name() string {
+	return modeNames[mode]
+}
+
+// IsBuiltIn reports whether the mode is one of the light's built-in animations, settable with SetMode
+func (mode Mode) IsBuiltIn() bool {
+	_, known := modeNames[mode]
+	return known && mode != ModeControl
+}
+
+func (mode Mode) String() string {
+	if name, ok := modeNames[mode]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown mode %d", uint8(mode))
+}
@@ -0,0 +1,174 @@
+package triones
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	statusHeader     = 0x66
+	statusTerminator = 0x99
+	// Length of a status frame, header and terminator included
+	StatusFrameLength = 12
+)
+
+var (
+	// ErrShortFrame is returned for frames shorter than a status frame
+	ErrShortFrame = errors.New("status frame is too short")
+	// ErrBadHeader is returned for data that doesn't start with the status frame header
+	ErrBadHeader = errors.New("not a status frame")
+	// ErrBadTerminator is returned for frames that don't end where they're supposed to
+	ErrBadTerminator = errors.New("status frame is not terminated")
+)
+
+// FrameError is returned for data that could not be decoded as a status frame
+type FrameError struct {
+	// One of ErrShortFrame, ErrBadHeader and ErrBadTerminator
+	Err error
+	// The offending bytes
+	Frame []byte
+}
+
+func (err *FrameError) Error() string {
+	return fmt.Sprintf("%v: %s", err.Err, hex.EncodeToString(err.Frame))
+}
+
+func (err *FrameError) Unwrap() error {
+	return err.Err
+}
+
+func newFrameError(err error, frame []byte) *FrameError {
+	frameCopy := make([]byte, len(frame))
+	copy(frameCopy, frame)
+	return &FrameError{Err: err, Frame: frameCopy}
+}
+
+// Status is the state of the light, as reported by a status frame
+type Status struct {
+	Power bool
+	Mode  Mode
+	Speed uint8
+	R     uint8
+	G     uint8
+	B     uint8
+	// Intensity of the white LEDs, 0 when the RGB LEDs are in use
+	White uint8
+}
+
+// UsesWhite reports whether the light is showing a color with its white LEDs
+func (status Status) UsesWhite() bool {
+	return status.Mode == ModeControl && status.White != 0
+}
+
+// DecodeStatus decodes a complete status frame sent by the light in response to RequestStatus. Errors are of type
+// *FrameError.
+func DecodeStatus(frame []byte) (status Status, err error) {
+	if len(frame) == 0 || frame[0] != statusHeader {
+		err = newFrameError(ErrBadHeader, frame)
+		return
+	}
+	if len(frame) < StatusFrameLength {
+		err = newFrameError(ErrShortFrame, frame)
+		return
+	}
+	if len(frame) > StatusFrameLength || frame[StatusFrameLength-1] != statusTerminator {
+		err = newFrameError(ErrBadTerminator, frame)
+		return
+	}
+
+	status.Power = frame[2] == 0x23
+	status.Mode = Mode(frame[3])
+	status.Speed = frame[5]
+	status.R = frame[6]
+	status.G = frame[7]
+	status.B = frame[8]
+	status.White = frame[9]
+	return
+}
+
+// FrameParser decodes status frames out of a stream of notifications.
+//
+// Some lights and adapters split frames across several notifications, or send more than one in a single notification.
+// The parser buffers incomplete frames until the rest comes in and resynchronizes on the next header after garbage.
+type FrameParser struct {
+	buffer []byte
+}
+
+// Feed parses a notification, returning the statuses that were completed by it and an error for each chunk of data
+// that had to be discarded.
+func (parser *FrameParser) Feed(data []byte) (statuses []Status, errs []error) {
+	parser.buffer = append(parser.buffer, data...)
+
+	for len(parser.buffer) > 0 {
+		// Skip anything before the next header
+		start := bytes.IndexByte(parser.buffer, statusHeader)
+		if start != 0 {
+			if start < 0 {
+				start = len(parser.buffer)
+			}
+			errs = append(errs, newFrameError(ErrBadHeader, parser.buffer[:start]))
+			parser.buffer = parser.buffer[start:]
+			continue
+		}
+
+		if len(parser.buffer) < StatusFrameLength {
+			// Wait for the rest of the frame
+			break
+		}
+
+		status, err := DecodeStatus(parser.buffer[:StatusFrameLength])
+		if err != nil {
+			// Not a frame after all, look for the next header
+			next := bytes.IndexByte(parser.buffer[1:], statusHeader)
+			if next < 0 {
+				next = len(parser.buffer) - 1
+			}
+			errs = append(errs, newFrameError(ErrBadTerminator, parser.buffer[:next+1]))
+			parser.buffer = parser.buffer[next+1:]
+			continue
+		}
+
+		statuses = append(statuses, status)
+		parser.buffer = parser.buffer[StatusFrameLength:]
+	}
+
+	// Don't hold on to the backing array of old notifications
+	if len(parser.buffer) == 0 {
+		parser.buffer = nil
+	}
+	return
+}
+
+// Pending returns the bytes of the incomplete frame the parser is waiting to complete
+func (parser *FrameParser) Pending() []byte {
+	return parser.buffer
+}
+
+// Reset drops any incomplete frame
+func (parser *FrameParser) Reset() {
+	parser.buffer = nil
+}
+
+// EncodeStatus encodes a status frame, as the light would send it
+func EncodeStatus(status Status) []byte {
+	frame := make([]byte, StatusFrameLength)
+	frame[0] = statusHeader
+	frame[1] = 0x15 // Device type, as reported by the lights we know of
+	if status.Power {
+		frame[2] = 0x23
+	} else {
+		frame[2] = 0x24
+	}
+	frame[3] = uint8(status.Mode)
+	frame[4] = 0x20
+	frame[5] = status.Speed
+	frame[6] = status.R
+	frame[7] = status.G
+	frame[8] = status.B
+	frame[9] = status.White
+	frame[10] = 0x01 // Firmware version
+	frame[StatusFrameLength-1] = statusTerminator
+	return frame
+}
@@ -0,0 +1,16 @@
+//go:build go1.18
+// +build go1.18
+
+package triones
+
+import (
+	"testing"
+)
+
+// Native fuzzing needs Go 1.18, TestFrameParser runs the same checks on the seeds and the corpus on any version
+func FuzzFrameParser(f *testing.F) {
+	for _, seed := range frameParserSeeds {
+		f.Add(seed.data, seed.cuts)
+	}
+	f.Fuzz(checkFrameParser)
+}
@@ -0,0 +1,246 @@
+package triones
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Status frames as sent by the lights
+var statusVectors = []struct {
+	name   string
+	status Status
+	frame  []byte
+}{
+	{
+		"color",
+		Status{Power: true, Mode: ModeControl, Speed: 0, R: 255, G: 134, B: 17},
+		[]byte{0x66, 0x15, 0x23, 0x41, 0x20, 0x00, 0xFF, 0x86, 0x11, 0x00, 0x01, 0x99},
+	},
+	{
+		"white",
+		Status{Power: true, Mode: ModeControl, White: 200},
+		[]byte{0x66, 0x15, 0x23, 0x41, 0x20, 0x00, 0x00, 0x00, 0x00, 0xC8, 0x01, 0x99},
+	},
+	{
+		"off running a mode",
+		Status{Power: false, Mode: 37, Speed: 10, R: 12, G: 34, B: 56},
+		[]byte{0x66, 0x15, 0x24, 0x25, 0x20, 0x0A, 0x0C, 0x22, 0x38, 0x00, 0x01, 0x99},
+	},
+}
+
+func TestEncodeStatus(t *testing.T) {
+	for _, vector := range statusVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			if frame := EncodeStatus(vector.status); !bytes.Equal(frame, vector.frame) {
+				t.Errorf("EncodeStatus() = % X, want % X", frame, vector.frame)
+			}
+		})
+	}
+}
+
+func TestDecodeStatus(t *testing.T) {
+	for _, vector := range statusVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			status, err := DecodeStatus(vector.frame)
+			if err != nil {
+				t.Fatalf("DecodeStatus() failed: %v", err)
+			}
+			if status != vector.status {
+				t.Errorf("DecodeStatus() = %+v, want %+v", status, vector.status)
+			}
+			if roundTrip, err := DecodeStatus(EncodeStatus(status)); err != nil || roundTrip != status {
+				t.Errorf("DecodeStatus(EncodeStatus()) = %+v, %v, want %+v", roundTrip, err, status)
+			}
+		})
+	}
+}
+
+func TestDecodeStatusErrors(t *testing.T) {
+	valid := statusVectors[0].frame
+	withByte := func(index int, value byte) []byte {
+		frame := append([]byte(nil), valid...)
+		frame[index] = value
+		return frame
+	}
+
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"empty", nil, ErrBadHeader},
+		{"bad header", withByte(0, 0x65), ErrBadHeader},
+		{"command instead of status", []byte{0x56, 0xFF, 0x86, 0x11, 0x00, 0xF0, 0xAA}, ErrBadHeader},
+		{"short", valid[:StatusFrameLength-1], ErrShortFrame},
+		{"header only", valid[:1], ErrShortFrame},
+		{"long", append(append([]byte(nil), valid...), 0x99), ErrBadTerminator},
+		{"bad terminator", withByte(StatusFrameLength-1, 0x98), ErrBadTerminator},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeStatus(test.frame)
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("DecodeStatus() error = %v, want a *FrameError", err)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("DecodeStatus() error = %v, want %v", err, test.err)
+			}
+			if !bytes.Equal(frameErr.Frame, test.frame) {
+				t.Errorf("FrameError.Frame = % X, want % X", frameErr.Frame, test.frame)
+			}
+		})
+	}
+}
+
+func TestUsesWhite(t *testing.T) {
+	for _, test := range []struct {
+		status Status
+		want   bool
+	}{
+		{Status{Mode: ModeControl, White: 200}, true},
+		{Status{Mode: ModeControl, R: 255}, false},
+		{Status{Mode: 37, White: 200}, false},
+	} {
+		if got := test.status.UsesWhite(); got != test.want {
+			t.Errorf("%+v.UsesWhite() = %v, want %v", test.status, got, test.want)
+		}
+	}
+}
+
+// Decodes every frame in the stream in one go, the way FrameParser should however it's split into notifications
+func decodeStream(data []byte) (statuses []Status) {
+	for i := 0; i+StatusFrameLength <= len(data); {
+		if status, err := DecodeStatus(data[i : i+StatusFrameLength]); err == nil {
+			statuses = append(statuses, status)
+			i += StatusFrameLength
+			continue
+		}
+		i++
+	}
+	return
+}
+
+// Stream of notifications for the frame parser, as the fuzz target takes it
+type frameParserSeed struct {
+	data []byte
+	// Sizes of the notifications the data is split into, the rest comes in a single one
+	cuts []byte
+}
+
+var frameParserSeeds = func() []frameParserSeed {
+	color, white, off := statusVectors[0].frame, statusVectors[1].frame, statusVectors[2].frame
+	concat := func(chunks ...[]byte) []byte {
+		return bytes.Join(chunks, nil)
+	}
+	return []frameParserSeed{
+		{color, nil},
+		{color, []byte{4}},
+		{color, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{concat(color, white, off), nil},
+		{concat(color, white, off), []byte{9, 15}},
+		{concat([]byte{0x00, 0x12, 0xAA}, color), nil},
+		{concat([]byte{0x66, 0x15, 0x23}, color), []byte{1}},
+		{concat(color[:7], white), nil},
+		{concat(white, color[:StatusFrameLength-1]), []byte{2, 10}},
+	}
+}()
+
+// Feeds the data to a parser split into notifications of the given sizes, checks it never panics, never holds on to a
+// frame worth of data and decodes every frame in the data exactly once
+func checkFrameParser(t *testing.T, data []byte, cuts []byte) {
+	var parser FrameParser
+	var statuses []Status
+	discarded := 0
+	for rest, i := data, 0; len(rest) > 0; i++ {
+		size := len(rest)
+		if i < len(cuts) {
+			size = int(cuts[i]%16) + 1
+			if size > len(rest) {
+				size = len(rest)
+			}
+		}
+		decoded, errs := parser.Feed(rest[:size])
+		rest = rest[size:]
+
+		statuses = append(statuses, decoded...)
+		for _, err := range errs {
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("Feed() error = %v, want a *FrameError", err)
+			}
+			discarded += len(frameErr.Frame)
+		}
+		if pending := len(parser.Pending()); pending >= StatusFrameLength {
+			t.Fatalf("%d bytes pending, want less than a frame", pending)
+		}
+	}
+
+	want := decodeStream(data)
+	if len(statuses) != len(want) {
+		t.Fatalf("Feed() decoded %d frames, want %d", len(statuses), len(want))
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("frame %d decoded as %+v, want %+v", i, statuses[i], want[i])
+		}
+	}
+	if consumed := len(statuses)*StatusFrameLength + discarded + len(parser.Pending()); consumed != len(data) {
+		t.Fatalf("%d bytes decoded, discarded or pending, want %d", consumed, len(data))
+	}
+}
+
+// Reads a file of the fuzz corpus, which holds one []byte("...") line for each argument of the fuzz target
+func readCorpusFile(path string) (data []byte, cuts []byte, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || lines[0] != "go test fuzz v1" {
+		return nil, nil, errors.New("not a corpus file with two arguments")
+	}
+	var args [2][]byte
+	for i, line := range lines[1:] {
+		if !strings.HasPrefix(line, "[]byte(") || !strings.HasSuffix(line, ")") {
+			return nil, nil, errors.New(fmt.Sprintf("argument %d is not a []byte", i))
+		}
+		arg, err := strconv.Unquote(strings.TrimSuffix(strings.TrimPrefix(line, "[]byte("), ")"))
+		if err != nil {
+			return nil, nil, err
+		}
+		args[i] = []byte(arg)
+	}
+	return args[0], args[1], nil
+}
+
+// Checks the seeds and the corpus of the fuzz target, whatever the Go version
+func TestFrameParser(t *testing.T) {
+	for i, seed := range frameParserSeeds {
+		t.Run(fmt.Sprintf("seed#%d", i), func(t *testing.T) {
+			checkFrameParser(t, seed.data, seed.cuts)
+		})
+	}
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "fuzz", "FuzzFrameParser", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no corpus found")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, cuts, err := readCorpusFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFrameParser(t, data, cuts)
+		})
+	}
+}
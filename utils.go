@@ -27,9 +27,10 @@ func getColorString(v1 uint8, v2 uint8, v3 uint8) string {
 
 func logCharacteristics(device *device.Device1) {
 	addr, _ := device.GetAddress()
+	deviceLog := withFields(bleLog, "address", addr)
 	chars, err := device.GetCharacteristics()
 	if err != nil {
-		log.Errorf("unable to retrieve characteristics for '%s': %v", addr, err)
+		deviceLog.Errorf("unable to retrieve characteristics: %v", err)
 		return
 	}
 
@@ -37,7 +38,17 @@ func logCharacteristics(device *device.Device1) {
 		uuid, _ := char.GetUUID()
 		flags, _ := char.GetFlags()
 
-		log.Debug("Device: ", addr)
-		log.Debugf("- char: %s %v", uuid, flags)
+		deviceLog.Debugf("characteristic: %s %v", uuid, flags)
 	}
-}
\ No newline at end of file
+}
+
+func stringPtr(str string) *string {
+	return &str
+}
+
+func equalStringPtr(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default minimum time between two writes to the same light
+	defaultMinWriteInterval = 50 * time.Millisecond
+	// Maximum number of writes waiting to be sent to a light
+	maxWriteQueueLength = 16
+)
+
+var ErrWriteQueueFull = errors.New("write queue is full")
+var ErrWriterStopped = errors.New("writer stopped")
+
+// Writes that supersede each other: only the latest write of each kind that is still in the queue is sent.
+type writeKind int
+
+const (
+	// Color, white and mode writes all replace what the light is showing
+	writeKindAppearance writeKind = iota
+	writeKindPower
+	writeKindStatusRequest
+)
+
+type writeRequest struct {
+	kind    writeKind
+	payload []byte
+	// Channels waiting for the outcome of the write, including those of the writes it superseded
+	results []chan<- error
+}
+
+type WriteStats struct {
+	// Writes accepted in the queue
+	Queued uint64
+	// Writes sent to the light successfully
+	Written uint64
+	// Writes dropped because a newer write of the same kind superseded them
+	Coalesced uint64
+	// Writes dropped because the queue was full or the writer was stopped
+	Dropped uint64
+	// Writes that failed
+	Failed uint64
+}
+
+// Serializes writes to a light.
+//
+// Writes are queued and sent one at a time by a single goroutine, leaving at least minInterval between them. Lights stop
+// responding when they're flooded with writes, which is what happens when a slider in a UI is dragged around, so queued
+// writes are coalesced: a new write replaces the pending one of the same kind.
+type lightWriter struct {
+	transport   Transport
+	minInterval time.Duration
+	lock        *sync.Mutex
+	queue       []*writeRequest
+	wakeChan    chan interface{}
+	stopped     bool
+	stats       *WriteStats
+	metrics     *deviceMetrics
+	log         *fieldLogger
+}
+
+func newLightWriter(
+	transport Transport,
+	minInterval time.Duration,
+	metrics *deviceMetrics,
+	log *fieldLogger,
+) *lightWriter {
+	return &lightWriter{
+		transport:   transport,
+		minInterval: minInterval,
+		metrics:     metrics,
+		log:         log,
+		lock:        &sync.Mutex{},
+		queue:       make([]*writeRequest, 0, maxWriteQueueLength),
+		wakeChan:    make(chan interface{}, 1),
+		stats:       &WriteStats{},
+	}
+}
+
+func getMinWriteInterval(deviceConfig *DeviceConfig) time.Duration {
+	if deviceConfig.MinWriteInterval != nil && *deviceConfig.MinWriteInterval >= 0 {
+		return time.Duration(*deviceConfig.MinWriteInterval * float64(time.Second))
+	}
+	return defaultMinWriteInterval
+}
+
+// Queues a write without waiting for it to be sent
+func (writer *lightWriter) Enqueue(kind writeKind, payload []byte) error {
+	return writer.enqueue(kind, payload, nil)
+}
+
+// Queues a write and waits until it's sent. Every queued write gets a result, ErrWriterStopped if the writer stops
+// before sending it.
+func (writer *lightWriter) Write(kind writeKind, payload []byte) error {
+	result := make(chan error, 1)
+	if err := writer.enqueue(kind, payload, result); err != nil {
+		return err
+	}
+	return <-result
+}
+
+func (writer *lightWriter) enqueue(kind writeKind, payload []byte, result chan<- error) error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	if writer.stopped {
+		atomic.AddUint64(&writer.stats.Dropped, 1)
+		return ErrWriterStopped
+	}
+
+	request := &writeRequest{kind: kind, payload: payload}
+	if result != nil {
+		request.results = append(request.results, result)
+	}
+
+	// The new write goes after everything queued so far, so it's never sent before a write of another kind that was
+	// queued ahead of it
+	for i, queued := range writer.queue {
+		if queued.kind == kind {
+			request.results = append(queued.results, request.results...)
+			writer.queue = append(writer.queue[:i], writer.queue[i+1:]...)
+			atomic.AddUint64(&writer.stats.Coalesced, 1)
+			break
+		}
+	}
+
+	if len(writer.queue) >= maxWriteQueueLength {
+		atomic.AddUint64(&writer.stats.Dropped, 1)
+		writer.log.Warning("write queue is full, dropping write")
+		return ErrWriteQueueFull
+	}
+
+	writer.queue = append(writer.queue, request)
+	atomic.AddUint64(&writer.stats.Queued, 1)
+
+	select {
+	case writer.wakeChan <- nil:
+	default:
+	}
+	return nil
+}
+
+func (writer *lightWriter) dequeue() *writeRequest {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	if len(writer.queue) == 0 {
+		return nil
+	}
+	request := writer.queue[0]
+	writer.queue = writer.queue[1:]
+	return request
+}
+
+// Stats returns a snapshot of the writer's counters
+func (writer *lightWriter) Stats() WriteStats {
+	return WriteStats{
+		Queued:    atomic.LoadUint64(&writer.stats.Queued),
+		Written:   atomic.LoadUint64(&writer.stats.Written),
+		Coalesced: atomic.LoadUint64(&writer.stats.Coalesced),
+		Dropped:   atomic.LoadUint64(&writer.stats.Dropped),
+		Failed:    atomic.LoadUint64(&writer.stats.Failed),
+	}
+}
+
+// Sends the queued writes until ctx is cancelled. Failed writes are reported to whoever is waiting for them, they don't
+// stop the writer.
+func (writer *lightWriter) Run(ctx context.Context) error {
+	var lastWrite time.Time
+
+Loop:
+	for {
+		request := writer.dequeue()
+		if request == nil {
+			select {
+			case <-writer.wakeChan:
+				continue Loop
+			case <-ctx.Done():
+				break Loop
+			}
+		}
+
+		if wait := writer.minInterval - time.Since(lastWrite); wait > 0 {
+			if !sleepContext(ctx, wait) {
+				writer.finish(request, ErrWriterStopped)
+				break Loop
+			}
+		}
+
+		startedAt := time.Now()
+		err := writer.transport.Write(request.payload)
+		lastWrite = time.Now()
+		writer.metrics.Written(lastWrite.Sub(startedAt), err)
+		if err != nil {
+			atomic.AddUint64(&writer.stats.Failed, 1)
+			if len(request.results) == 0 {
+				writer.log.Error("unable to write to light: ", err)
+			}
+		} else {
+			atomic.AddUint64(&writer.stats.Written, 1)
+		}
+		writer.finish(request, err)
+	}
+
+	// Whatever is left won't be sent
+	writer.lock.Lock()
+	writer.stopped = true
+	queue := writer.queue
+	writer.queue = nil
+	writer.lock.Unlock()
+	for _, request := range queue {
+		writer.finish(request, ErrWriterStopped)
+	}
+
+	stats := writer.Stats()
+	writer.log.Debugf("writer stopped: %d queued, %d written, %d coalesced, %d dropped, %d failed",
+		stats.Queued, stats.Written, stats.Coalesced, stats.Dropped, stats.Failed)
+	return nil
+}
+
+func (writer *lightWriter) finish(request *writeRequest, err error) {
+	if err == ErrWriterStopped {
+		atomic.AddUint64(&writer.stats.Dropped, 1)
+	}
+	for _, result := range request.results {
+		result <- err
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// Transport that hands what is written to it over to the test
+type recordingTransport struct {
+	written chan []byte
+}
+
+func (transport *recordingTransport) Write(payload []byte) error {
+	transport.written <- payload
+	return nil
+}
+
+func (transport *recordingTransport) Subscribe() (<-chan []byte, error) {
+	return make(chan []byte), nil
+}
+
+func (transport *recordingTransport) Unsubscribe() error {
+	return nil
+}
+
+func TestWriterCoalescesInOrder(t *testing.T) {
+	transport := &recordingTransport{written: make(chan []byte, maxWriteQueueLength)}
+	writer := newLightWriter(transport, 0, nil, deviceLogger(bleLog, "00:00:00:00:00:00", "test"))
+
+	// Queued before the writer runs, so they're all pending at once
+	for _, write := range []struct {
+		kind    writeKind
+		payload string
+	}{
+		{writeKindAppearance, "first color"},
+		{writeKindPower, "power off"},
+		{writeKindAppearance, "second color"},
+		{writeKindStatusRequest, "status"},
+		{writeKindAppearance, "third color"},
+	} {
+		if err := writer.Enqueue(write.kind, []byte(write.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan interface{})
+	go func() {
+		defer close(done)
+		_ = writer.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A fade to off ends with its last frame, the power off and the color to come back on with: the latter must not
+	// be sent before the power off
+	for _, want := range []string{"power off", "status", "third color"} {
+		select {
+		case payload := <-transport.written:
+			if !bytes.Equal(payload, []byte(want)) {
+				t.Fatalf("wrote %q, want %q", payload, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q not written", want)
+		}
+	}
+	if stats := writer.Stats(); stats.Queued != 5 || stats.Coalesced != 2 {
+		t.Errorf("stats = %+v, want 5 queued and 2 coalesced", stats)
+	}
+}